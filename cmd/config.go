@@ -19,17 +19,37 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"time"
 
+	"github.com/redBorder/dswatcher/internal/updater"
 	yaml "gopkg.in/yaml.v2"
 )
 
+// KafkaClusterConfig contains the configuration of the Kafka cluster used by
+// one of the consumers.
+type KafkaClusterConfig struct {
+	Address       string            `yaml:"address"`
+	ConsumerGroup string            `yaml:"consumer_group"`
+	Topics        []string          `yaml:"topics"`
+	Properties    map[string]string `yaml:"properties"`
+}
+
 // DynamicSensorsWatcherConfig contains the main application configuration
 type DynamicSensorsWatcherConfig struct {
 	Broker struct {
-		Address       string   `yaml:"address"`
-		ConsumerGroup string   `yaml:"consumer_group"`
-		NetflowTopics []string `yaml:"netflow_topics"`
-		LimitsTopics  []string `yaml:"limits_topics"`
+		Address           string            `yaml:"address"`
+		ConsumerGroup     string            `yaml:"consumer_group"`
+		NetflowTopics     []string          `yaml:"netflow_topics"`
+		LimitsTopics      []string          `yaml:"limits_topics"`
+		Properties        map[string]string `yaml:"properties"`
+		NetflowProperties map[string]string `yaml:"netflow_properties"`
+		LimitsProperties  map[string]string `yaml:"limits_properties"`
+		LimitsMaxAge      int64             `yaml:"limits_max_age_s"`
+		LimitsNoTimestamp bool              `yaml:"limits_allow_missing_timestamp"`
+
+		Netflow KafkaClusterConfig `yaml:"netflow"`
+		Limits  KafkaClusterConfig `yaml:"limits"`
 	}
 
 	Decoder struct {
@@ -54,7 +74,59 @@ type DynamicSensorsWatcherConfig struct {
 		DataBagItem          string `yaml:"data_bag_item"`
 		UpdateInterval       int64  `yaml:"update_interval_s"`
 		FetchInterval        int64  `yaml:"fetch_interval_s"`
+		FetchConcurrency     int    `yaml:"fetch_concurrency"`
+		SearchQuery          string `yaml:"search_query"`
+		PartialSearch        bool   `yaml:"partial_search"`
 		SkipSSL              bool   `yaml:"skip_ssl"`
+		OutboxPath           string `yaml:"outbox_path"`
+		DryRun               bool   `yaml:"dry_run"`
+		CheckLicenseExpiry   bool   `yaml:"check_license_expiry"`
+		LicenseGracePeriod   int64  `yaml:"license_grace_period_s"`
+		LicenseExpiredPath   string `yaml:"license_expired_path"`
+		ConflictWindow       int64  `yaml:"conflict_window_s"`
+
+		AddressConfirmation struct {
+			Sightings int   `yaml:"sightings"`
+			Period    int64 `yaml:"period_s"`
+			Window    int64 `yaml:"window_s"`
+		} `yaml:"address_confirmation"`
+
+		Provisioning struct {
+			Mode        string `yaml:"mode"`
+			NodePrefix  string `yaml:"node_prefix"`
+			DataBagName string `yaml:"data_bag_name"`
+			TTL         int64  `yaml:"ttl_s"`
+			Rate        int    `yaml:"rate_per_minute"`
+		} `yaml:"provisioning"`
+
+		Defaults struct {
+			Blocked       bool   `yaml:"blocked"`
+			IPAddress     string `yaml:"ipaddress"`
+			ObservationID string `yaml:"observation_id"`
+		} `yaml:"defaults"`
+
+		Retry struct {
+			MaxRetries       *int  `yaml:"max_retries"`
+			InitialBackoff   int64 `yaml:"initial_backoff_ms"`
+			MaxBackoff       int64 `yaml:"max_backoff_ms"`
+			Budget           *int  `yaml:"budget_per_minute"`
+			BreakerThreshold int   `yaml:"breaker_threshold"`
+			BreakerCooldown  int64 `yaml:"breaker_cooldown_s"`
+		} `yaml:"retry"`
+	}
+
+	ProductTypes struct {
+		Valid        []uint32            `yaml:"valid"`
+		Wildcards    []uint32            `yaml:"wildcards"`
+		AllowMissing *bool               `yaml:"allow_missing"`
+		Block        map[string][]uint32 `yaml:"block"`
+	} `yaml:"product_types"`
+
+	Audit struct {
+		File       string `yaml:"file"`
+		MaxSize    int64  `yaml:"max_size_mb"`
+		MaxBackups int    `yaml:"max_backups"`
+		Topic      string `yaml:"topic"`
 	}
 }
 
@@ -67,5 +139,124 @@ func ParseConfig(raw []byte) (DynamicSensorsWatcherConfig, error) {
 		return config, errors.New("Error: " + err.Error())
 	}
 
+	b := &config.Broker
+	b.Netflow = mergeClusterConfig(b.Netflow, KafkaClusterConfig{
+		Address:       b.Address,
+		ConsumerGroup: b.ConsumerGroup,
+		Topics:        b.NetflowTopics,
+		Properties:    mergeProperties(b.Properties, b.NetflowProperties),
+	})
+	b.Limits = mergeClusterConfig(b.Limits, KafkaClusterConfig{
+		Address:       b.Address,
+		ConsumerGroup: b.ConsumerGroup,
+		Topics:        b.LimitsTopics,
+		Properties:    mergeProperties(b.Properties, b.LimitsProperties),
+	})
+
+	if len(b.Netflow.Address) == 0 {
+		return config, errors.New("Error: No broker address for netflow")
+	}
+	if len(b.Limits.Address) == 0 {
+		return config, errors.New("Error: No broker address for limits")
+	}
+
+	for alertType := range config.ProductTypes.Block {
+		if !blockingAlertTypes[alertType] {
+			return config, fmt.Errorf(
+				"Error: Alert type %q on product_types block doesn't block sensors", alertType)
+		}
+	}
+
 	return config, nil
 }
+
+// blockingAlertTypes are the limits alert types that block or unblock the
+// sensors of an organization.
+var blockingAlertTypes = map[string]bool{
+	"limit_reached": true,
+	"unknown_uuid":  true,
+	"limit_reset":   true,
+}
+
+// BlockedProductTypes returns the product types of the sensors blocked or
+// unblocked by a limits alert type. Only the generic product type is blocked
+// if the alert type is not configured.
+func (c DynamicSensorsWatcherConfig) BlockedProductTypes(alertType string) []uint32 {
+	if productTypes, ok := c.ProductTypes.Block[alertType]; ok {
+		return productTypes
+	}
+
+	return []uint32{updater.GenericProductType}
+}
+
+// ProductTypePolicy returns the product types policy of the updater. Nodes
+// without product type are allowed unless "allow_missing" is false.
+func (c DynamicSensorsWatcherConfig) ProductTypePolicy() updater.ProductTypePolicy {
+	return updater.ProductTypePolicy{
+		Valid:         c.ProductTypes.Valid,
+		Wildcards:     c.ProductTypes.Wildcards,
+		RejectMissing: c.ProductTypes.AllowMissing != nil && !*c.ProductTypes.AllowMissing,
+	}
+}
+
+// RetryConfig returns the configuration for retrying failed requests to the
+// Chef API. Retries are disabled if "max_retries" or "budget_per_minute" are
+// set to 0.
+func (c DynamicSensorsWatcherConfig) RetryConfig() updater.RetryConfig {
+	retry := c.Updater.Retry
+
+	return updater.RetryConfig{
+		MaxRetries:       disabledIfZero(retry.MaxRetries),
+		InitialBackoff:   time.Duration(retry.InitialBackoff) * time.Millisecond,
+		MaxBackoff:       time.Duration(retry.MaxBackoff) * time.Millisecond,
+		Budget:           disabledIfZero(retry.Budget),
+		BreakerThreshold: retry.BreakerThreshold,
+		BreakerCooldown:  time.Duration(retry.BreakerCooldown) * time.Second,
+	}
+}
+
+// disabledIfZero returns the value of an optional setting of the updater,
+// which uses zero for the default value and a negative one for disabled.
+func disabledIfZero(value *int) int {
+	switch {
+	case value == nil:
+		return 0
+	case *value == 0:
+		return -1
+	}
+
+	return *value
+}
+
+// mergeClusterConfig fills the unset fields of a cluster configuration with
+// the values of the top level "broker" section.
+func mergeClusterConfig(
+	cluster KafkaClusterConfig,
+	defaults KafkaClusterConfig,
+) KafkaClusterConfig {
+	if len(cluster.Address) == 0 {
+		cluster.Address = defaults.Address
+	}
+	if len(cluster.ConsumerGroup) == 0 {
+		cluster.ConsumerGroup = defaults.ConsumerGroup
+	}
+	if len(cluster.Topics) == 0 {
+		cluster.Topics = defaults.Topics
+	}
+	cluster.Properties = mergeProperties(defaults.Properties, cluster.Properties)
+
+	return cluster
+}
+
+// mergeProperties returns a new map with the given properties. Later maps
+// override the earlier ones.
+func mergeProperties(properties ...map[string]string) map[string]string {
+	merged := make(map[string]string)
+	for _, props := range properties {
+		for key, value := range props {
+			merged[key] = value
+		}
+	}
+
+	return merged
+}
@@ -33,11 +33,10 @@ import (
 	prefixed "github.com/x-cray/logrus-prefixed-formatter"
 )
 
-const genericProductType = 999
-
 var (
 	version    string
 	configFile string
+	dryRun     bool
 	log        = logrus.New()
 )
 
@@ -46,10 +45,15 @@ func init() {
 		ForceColors:      true,
 		DisableTimestamp: true,
 	}
+}
 
+// parseFlags reads the command line flags. It's not done on init, so the
+// flags of "go test" are not parsed as the application ones.
+func parseFlags() {
 	versionFlag := flag.Bool("version", false, "Show version info")
 	debugFlag := flag.Bool("debug", false, "Show debug info")
 	configFlag := flag.String("config", "", "Application configuration file")
+	dryRunFlag := flag.Bool("dry-run", false, "Log node changes instead of sending them to Chef")
 	flag.Parse()
 
 	if *versionFlag {
@@ -67,9 +71,12 @@ func init() {
 	}
 
 	configFile = *configFlag
+	dryRun = *dryRunFlag
 }
 
 func main() {
+	parseFlags()
+
 	wg := new(sync.WaitGroup)
 
 	////////////////////
@@ -106,6 +113,12 @@ func main() {
 		log.Fatal("Error reading client Key: " + err.Error())
 	}
 
+	auditor, closeAudit, err := BootstrapAudit(config)
+	if err != nil {
+		log.Fatal("Error creating audit trail: " + err.Error())
+	}
+	defer closeAudit()
+
 	chefUpdater, err := updater.NewChefUpdater(updater.ChefUpdaterConfig{
 		URL:                  config.Updater.URL,
 		AccessKey:            string(key),
@@ -121,15 +134,51 @@ func main() {
 		DataBagName:          config.Updater.DataBagName,
 		DataBagItem:          config.Updater.DataBagItem,
 		SkipSSL:              config.Updater.SkipSSL,
+		FetchConcurrency:     config.Updater.FetchConcurrency,
+		SearchQuery:          config.Updater.SearchQuery,
+		PartialSearch:        config.Updater.PartialSearch,
+		OutboxPath:           config.Updater.OutboxPath,
+		DryRun:               dryRun || config.Updater.DryRun,
+		CheckLicenseExpiry:   config.Updater.CheckLicenseExpiry,
+		LicenseGracePeriod:   time.Duration(config.Updater.LicenseGracePeriod) * time.Second,
+		LicenseExpiredPath:   config.Updater.LicenseExpiredPath,
+		Auditor:              auditor,
+		ConflictWindow:       time.Duration(config.Updater.ConflictWindow) * time.Second,
+		AddressConfirmation: updater.AddressConfirmation{
+			Sightings: config.Updater.AddressConfirmation.Sightings,
+			Period:    time.Duration(config.Updater.AddressConfirmation.Period) * time.Second,
+			Window:    time.Duration(config.Updater.AddressConfirmation.Window) * time.Second,
+		},
+		ProductTypes: config.ProductTypePolicy(),
+		Provisioning: updater.ProvisioningConfig{
+			Mode:        config.Updater.Provisioning.Mode,
+			NodePrefix:  config.Updater.Provisioning.NodePrefix,
+			DataBagName: config.Updater.Provisioning.DataBagName,
+			TTL:         time.Duration(config.Updater.Provisioning.TTL) * time.Second,
+			Rate:        config.Updater.Provisioning.Rate,
+		},
+		Defaults: updater.AttributeDefaults{
+			Blocked:       config.Updater.Defaults.Blocked,
+			IPAddress:     config.Updater.Defaults.IPAddress,
+			ObservationID: config.Updater.Defaults.ObservationID,
+		},
+		Retry: config.RetryConfig(),
 	})
 	if err != nil {
 		log.Fatal("Error creating Chef API client: " + err.Error())
 	}
+	defer chefUpdater.Close()
+
+	if chefUpdater.DryRun {
+		log.Warnln("Dry run: Changes will be logged but not sent to Chef")
+	}
 
-	err = chefUpdater.FetchNodes()
+	summary, err := chefUpdater.FetchNodes()
 	if err != nil {
 		log.Errorln("Error fetching nodes: " + err.Error())
 	}
+	LogFetchSummary(summary)
+	ReplayOutbox(chefUpdater)
 
 	fetchSignal :=
 		time.NewTicker(time.Duration(config.Updater.FetchInterval) * time.Second)
@@ -139,15 +188,17 @@ func main() {
 	////////////////////
 
 	consumerConfig, err := BootstrapRdKafka(
-		config.Broker.Address,
-		config.Broker.ConsumerGroup,
-		config.Broker.NetflowTopics,
-		config.Broker.LimitsTopics,
+		config.Broker.Netflow,
+		config.Broker.Limits,
 	)
 	if err != nil {
 		log.Fatal("Error creating Kafka config: " + err.Error())
 	}
 
+	consumerConfig.LimitsMaxAge =
+		time.Duration(config.Broker.LimitsMaxAge) * time.Second
+	consumerConfig.LimitsAllowUntimestamped = config.Broker.LimitsNoTimestamp
+
 	kafkaConsumer, err := consumer.NewKafkaConsumer(consumerConfig)
 	if err != nil {
 		log.Fatal("Error creating Kafka consumer: " + err.Error())
@@ -166,6 +217,8 @@ func main() {
 		lastUpdated := make(map[string]time.Time)
 
 		for message := range nfMessages {
+			WaitForChef(chefUpdater)
+
 			sensor, err := nfDecoder.Decode(message.IP, message.Data)
 			if err != nil {
 				log.Errorln("Error decoding netflow: " + err.Error())
@@ -179,12 +232,15 @@ func main() {
 			ip := make(net.IP, 4)
 			binary.BigEndian.PutUint32(ip, message.IP)
 
-			if time.Since(lastUpdated[sensor.SerialNumber]) <
+			// Throttled by address too, so a second exporter sending the same
+			// serial number is not hidden from the conflict detection
+			sighting := sensor.SerialNumber + "|" + ip.String()
+			if time.Since(lastUpdated[sighting]) <
 				time.Duration(config.Updater.UpdateInterval)*time.Second {
 				continue
 			}
 
-			lastUpdated[sensor.SerialNumber] = time.Now()
+			lastUpdated[sighting] = time.Now()
 
 			err = chefUpdater.UpdateNode(
 				ip,
@@ -192,6 +248,27 @@ func main() {
 				sensor.ObservationID,
 				sensor.ProductType,
 			)
+			if _, ok := err.(*updater.ConflictError); ok {
+				log.Debugf("Sensor not updated [%s | %s]: %s",
+					sensor.SerialNumber, ip.String(), err.Error())
+				continue
+			}
+			if unknown, ok := err.(*updater.UnknownSensorError); ok {
+				if unknown.Sightings == 1 {
+					log.Infof("Unknown sensor pending approval [%s | %s | provisioned: %t]",
+						unknown.SerialNumber, unknown.Address, unknown.Provisioned)
+				}
+				log.Debugln(err.Error())
+				continue
+			}
+			if pending, ok := err.(*updater.UnconfirmedAddressError); ok {
+				if pending.Sightings == 1 {
+					log.Infof("New address for sensor %s pending confirmation [%s -> %s]",
+						pending.SerialNumber, pending.Current, pending.Address)
+				}
+				log.Debugln(err.Error())
+				continue
+			}
 			if err != nil {
 				log.Warnf("Error updating node [%s | %s]: %s",
 					sensor.SerialNumber, ip.String(), err.Error())
@@ -214,6 +291,14 @@ func main() {
 		wg.Done()
 	}()
 
+	if conflictEvents := chefUpdater.ConflictEvents(); conflictEvents != nil {
+		go func() {
+			for event := range conflictEvents {
+				LogConflictEvent(event)
+			}
+		}()
+	}
+
 	//////////////////////////////////////////////////////////////////////////////
 	// Sensors limits messages
 	//////////////////////////////////////////////////////////////////////////////
@@ -229,20 +314,30 @@ func main() {
 		for {
 			select {
 			case <-fetchSignal.C:
-				err = chefUpdater.FetchNodes()
+				summary, err := chefUpdater.FetchNodes()
+				LogFetchSummary(summary)
 				if err != nil {
 					log.Errorln("Error fetching nodes: " + err.Error())
 					continue
 				}
 
-				log.Debugln("Sensors DB updated")
+				ReplayOutbox(chefUpdater)
+
+				stats := chefUpdater.WriteStats()
+				log.Debugf("Sensors DB updated [node updates sent: %d | skipped: %d | pending: %d]",
+					stats.Writes, stats.Skipped, chefUpdater.OutboxDepth())
+				LogPendingAddresses(chefUpdater)
+				LogUnknownSensors(chefUpdater)
 
 			case message, ok := <-limitsMessages:
 				if !ok {
 					break receiving
 				}
 
-				switch m := message.(type) {
+				WaitForChef(chefUpdater)
+				trigger := "kafka " + message.Origin.String()
+
+				switch m := message.Message.(type) {
 				case consumer.BlockOrganization:
 					if time.Since(lastBlocked) <
 						time.Duration(config.Updater.UpdateInterval)*time.Second {
@@ -252,8 +347,9 @@ func main() {
 					lastBlocked = time.Now()
 					org := string(m)
 
-					errs := chefUpdater.BlockOrganization(org, genericProductType)
-					if err != nil {
+					errs := chefUpdater.BlockOrganization(org,
+						config.BlockedProductTypes(message.Type), trigger)
+					if len(errs) > 0 {
 						for _, err := range errs {
 							log.Warnf("Error blocking sensor %s: %s", org, err.Error())
 						}
@@ -262,25 +358,55 @@ func main() {
 
 					log.Infoln("Blocked organization: " + org)
 
-				case consumer.AllowLicense:
-					errs := chefUpdater.AllowLicense(m.License)
-					if err != nil {
+				case consumer.UnblockOrganization:
+					org := string(m)
+
+					errs := chefUpdater.UnblockOrganization(org,
+						config.BlockedProductTypes(message.Type), trigger)
+					if len(errs) > 0 {
 						for _, err := range errs {
-							log.Warnf("Error blocking license %s: %s", m.License, err.Error())
+							log.Warnf("Error unblocking sensor %s: %s", org, err.Error())
 						}
 						continue receiving
 					}
 
-					log.Infoln("Allowed license: " + m.License)
+					log.Infoln("Unblocked organization: " + org)
+
+				case consumer.LimitWarning:
+					log.Warnf("Organization %s is close to its limit: %d of %d bytes",
+						m.Organization, m.CurrentBytes, m.Limit)
+
+				case consumer.AllowedLicenses:
+					summary, errs := chefUpdater.ReconcileLicenses(m.Licenses, trigger)
+					for _, err := range errs {
+						log.Warnf("Error applying allowed licenses: %s", err.Error())
+					}
+					for _, uuid := range summary.Unlicensed {
+						log.Warnf("Sensor %s has no license assigned", uuid)
+					}
+
+					log.Infof("Applied %d allowed licenses [blocked: %d | unblocked: %d | unchanged: %d]",
+						len(m.Licenses), summary.Blocked, summary.Unblocked, summary.Unchanged)
+
+				case consumer.BlockSensor:
+					err := chefUpdater.BlockSensor(m.UUID, m.SerialNumber, trigger)
+					if err != nil {
+						log.Warnf("Error blocking sensor [%s | %s]: %s",
+							m.UUID, m.SerialNumber, err.Error())
+						continue receiving
+					}
+
+					log.Infof("Blocked sensor [%s | %s]", m.UUID, m.SerialNumber)
 
-				case consumer.ResetSensors:
-					err := chefUpdater.ResetAllSensors()
+				case consumer.UnblockSensor:
+					err := chefUpdater.UnblockSensor(m.UUID, m.SerialNumber, trigger)
 					if err != nil {
-						log.Errorf("Error resetting sensors: %s", err.Error())
+						log.Warnf("Error unblocking sensor [%s | %s]: %s",
+							m.UUID, m.SerialNumber, err.Error())
 						continue receiving
 					}
 
-					log.Infof("All sensors has been reset")
+					log.Infof("Unblocked sensor [%s | %s]", m.UUID, m.SerialNumber)
 
 				default:
 					log.Warnln("Unknown message received")
@@ -18,11 +18,18 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"os"
 	"runtime"
+	"strings"
+	"time"
 
 	rdkafka "github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/redBorder/dswatcher/internal/audit"
 	"github.com/redBorder/dswatcher/internal/consumer"
+	"github.com/redBorder/dswatcher/internal/updater"
+	"github.com/sirupsen/logrus"
 )
 
 // PrintVersion displays the application version.
@@ -33,47 +40,232 @@ func PrintVersion() {
 	fmt.Printf("librdkafka\t\t:: %s\n", s)
 }
 
-// BootstrapRdKafka creates a Kafka consumer configuration struct.
-func BootstrapRdKafka(
-	broker, consumerGroup string,
-	nfTopics []string,
-	limitsTopics []string,
-	additionalAttributes ...string,
-) (config consumer.KakfaConsumerConfig, err error) {
+// LogFetchSummary logs the result of refreshing the sensors database.
+func LogFetchSummary(summary updater.FetchSummary) {
+	for _, err := range summary.Errors {
+		log.Warnln(err.Error())
+	}
 
-	nfAttributes := &rdkafka.ConfigMap{
-		"bootstrap.servers":               broker,
-		"group.id":                        consumerGroup,
-		"go.events.channel.enable":        true,
-		"go.application.rebalance.enable": true,
+	log.Infof("Fetched nodes [sensors: %d | skipped: %d | failed: %d | removed: %d]",
+		summary.Fetched, summary.Skipped, summary.Failed, summary.Removed)
+
+	if summary.Expired > 0 || summary.Renewed > 0 {
+		log.Infof("Checked licenses [expired: %d | renewed: %d]",
+			summary.Expired, summary.Renewed)
 	}
-	limitsAttributes := &rdkafka.ConfigMap{
-		"bootstrap.servers":               broker,
-		"group.id":                        consumerGroup,
-		"go.events.channel.enable":        true,
-		"go.application.rebalance.enable": true,
+
+	if summary.Approved > 0 {
+		log.Infof("Approved sensors [created: %d]", summary.Approved)
 	}
-	for _, attr := range additionalAttributes {
-		nfAttributes.Set(attr)
-		limitsAttributes.Set(attr)
+}
+
+// ReplayOutbox sends the pending changes to Chef and logs the result.
+func ReplayOutbox(chefUpdater *updater.ChefUpdater) {
+	if chefUpdater.OutboxDepth() == 0 {
+		return
 	}
 
-	nfConsumer, err := rdkafka.NewConsumer(nfAttributes)
+	replayed, err := chefUpdater.ReplayOutbox()
 	if err != nil {
+		log.Warnln("Error replaying pending node updates: " + err.Error())
+	}
+
+	log.Infof("Replayed pending node updates [nodes: %d | pending: %d]",
+		replayed, chefUpdater.OutboxDepth())
+}
+
+// LogConflictEvent logs the detection or resolution of a conflict between
+// sensors.
+func LogConflictEvent(event updater.ConflictEvent) {
+	if event.Resolved {
+		log.Infof("Sensor conflict resolved: %s", event.Conflict.String())
 		return
 	}
-	limitsConsumer, err := rdkafka.NewConsumer(limitsAttributes)
-	if err != nil {
+
+	log.WithFields(logrus.Fields{
+		"kind":   event.Kind,
+		"key":    event.Key,
+		"values": event.Values,
+	}).Errorf("Sensor conflict detected, updates paused: %s", event.Conflict.String())
+}
+
+// LogPendingAddresses logs the new addresses of the sensors waiting to be
+// confirmed.
+func LogPendingAddresses(chefUpdater *updater.ChefUpdater) {
+	for _, pending := range chefUpdater.PendingAddresses() {
+		log.Debugf("Address pending confirmation [%s | %s -> %s | sightings: %d | since: %s]",
+			pending.SerialNumber, pending.Current, pending.Address,
+			pending.Sightings, pending.FirstSeen.Format(time.RFC3339))
+	}
+}
+
+// LogUnknownSensors logs the serial numbers that don't belong to any sensor.
+func LogUnknownSensors(chefUpdater *updater.ChefUpdater) {
+	for _, unknown := range chefUpdater.UnknownSensors() {
+		log.Debugf("Unknown sensor [%s | %s | sightings: %d | since: %s | provisioned: %t]",
+			unknown.SerialNumber, unknown.Address, unknown.Sightings,
+			unknown.FirstSeen.Format(time.RFC3339), unknown.Provisioned)
+	}
+}
+
+// WaitForChef pauses the consumption of Kafka messages while the Chef API is
+// unavailable. Messages are not read from the consumer meanwhile, so they are
+// kept on Kafka instead of being dropped.
+func WaitForChef(chefUpdater *updater.ChefUpdater) {
+	if chefUpdater.Available() {
 		return
 	}
 
+	log.Warnln("Chef API unavailable, pausing Kafka consumption")
+	for !chefUpdater.Available() {
+		chefUpdater.WaitAvailable()
+	}
+	log.Infoln("Resuming Kafka consumption")
+}
+
+// rdKafkaFileProperties are the librdkafka properties that point to files
+// that must be readable when the consumers are created.
+var rdKafkaFileProperties = []string{
+	"ssl.ca.location",
+	"ssl.certificate.location",
+	"ssl.key.location",
+	"ssl.crl.location",
+	"ssl.keystore.location",
+	"sasl.kerberos.keytab",
+}
+
+// BootstrapRdKafka creates a Kafka consumer configuration struct. The Netflow
+// and limits consumers may connect to different Kafka clusters.
+func BootstrapRdKafka(
+	netflow KafkaClusterConfig,
+	limits KafkaClusterConfig,
+) (config consumer.KakfaConsumerConfig, err error) {
+	nfConsumer, err := newRdKafkaConsumer(netflow)
+	if err != nil {
+		return config, errors.New("Netflow consumer: " + err.Error())
+	}
+	limitsConsumer, err := newRdKafkaConsumer(limits)
+	if err != nil {
+		nfConsumer.Close()
+		return config, errors.New("Limits consumer: " + err.Error())
+	}
+
 	config = consumer.KakfaConsumerConfig{
 		NetflowConsumer: nfConsumer,
-		NetflowTopics:   nfTopics,
+		NetflowTopics:   netflow.Topics,
 
 		LimitsConsumer: limitsConsumer,
-		LimitsTopics:   limitsTopics,
+		LimitsTopics:   limits.Topics,
 	}
 
 	return
 }
+
+// BootstrapAudit creates the auditors for the node changes: a rotating file
+// and/or a Kafka topic on the limits cluster. The returned function closes
+// them. Nil is returned if the audit trail is disabled.
+func BootstrapAudit(
+	config DynamicSensorsWatcherConfig,
+) (updater.Auditor, func(), error) {
+	var auditors audit.Multi
+	var closers []func()
+
+	closeAll := func() {
+		for _, closer := range closers {
+			closer()
+		}
+	}
+
+	if len(config.Audit.File) > 0 {
+		fileAuditor, err := audit.NewFileAuditor(config.Audit.File,
+			config.Audit.MaxSize*1024*1024, config.Audit.MaxBackups)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		auditors = append(auditors, fileAuditor)
+		closers = append(closers, func() { fileAuditor.Close() })
+	}
+
+	if len(config.Audit.Topic) > 0 {
+		producer, err := newRdKafkaProducer(config.Broker.Limits)
+		if err != nil {
+			closeAll()
+			return nil, nil, errors.New("Audit producer: " + err.Error())
+		}
+
+		kafkaAuditor := audit.NewKafkaAuditor(producer, config.Audit.Topic)
+		auditors = append(auditors, kafkaAuditor)
+		closers = append(closers, func() { kafkaAuditor.Close(5000) })
+	}
+
+	if len(auditors) == 0 {
+		return nil, func() {}, nil
+	}
+
+	return auditors, closeAll, nil
+}
+
+// newRdKafkaProducer creates a rdkafka producer for the given cluster.
+func newRdKafkaProducer(cluster KafkaClusterConfig) (*rdkafka.Producer, error) {
+	attributes := &rdkafka.ConfigMap{
+		"bootstrap.servers": cluster.Address,
+	}
+
+	err := setRdKafkaProperties(attributes, cluster.Properties)
+	if err != nil {
+		return nil, errors.New("Invalid properties: " + err.Error())
+	}
+
+	return rdkafka.NewProducer(attributes)
+}
+
+// newRdKafkaConsumer creates a rdkafka consumer for the given cluster.
+func newRdKafkaConsumer(cluster KafkaClusterConfig) (*rdkafka.Consumer, error) {
+	attributes := &rdkafka.ConfigMap{
+		"bootstrap.servers":               cluster.Address,
+		"group.id":                        cluster.ConsumerGroup,
+		"go.events.channel.enable":        true,
+		"go.application.rebalance.enable": true,
+	}
+
+	err := setRdKafkaProperties(attributes, cluster.Properties)
+	if err != nil {
+		return nil, errors.New("Invalid properties: " + err.Error())
+	}
+
+	return rdkafka.NewConsumer(attributes)
+}
+
+// setRdKafkaProperties applies the given properties to a rdkafka
+// configuration. Properties used internally by the consumer ("go.*") can't be
+// set and files referenced by TLS/SASL properties must be readable.
+func setRdKafkaProperties(
+	attributes *rdkafka.ConfigMap,
+	properties map[string]string,
+) error {
+	for _, key := range rdKafkaFileProperties {
+		path, ok := properties[key]
+		if !ok || len(path) == 0 {
+			continue
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("%s: %s", key, err.Error())
+		}
+		f.Close()
+	}
+
+	for key, value := range properties {
+		if strings.HasPrefix(key, "go.") {
+			return fmt.Errorf("property %q is managed by dswatcher", key)
+		}
+
+		if err := attributes.SetKey(key, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,87 @@
+// Service for allowing new sensors to send flow based on a serial number.
+// Copyright (C) 2017 ENEO Tecnologia SL
+// Author: Diego Fernández Barrear <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	rdkafka "github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetRdKafkaProperties(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dswatcher")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	readable := filepath.Join(dir, "ca.pem")
+	assert.NoError(t, ioutil.WriteFile(readable, []byte("certificate"), 0600))
+	missing := filepath.Join(dir, "missing.pem")
+
+	type testCase struct {
+		name       string
+		properties map[string]string
+		err        string
+	}
+
+	testCases := []testCase{
+		{
+			name:       "Valid properties",
+			properties: map[string]string{"security.protocol": "ssl", "ssl.ca.location": readable},
+		},
+		{
+			name:       "Empty file path",
+			properties: map[string]string{"ssl.ca.location": ""},
+		},
+		{
+			name:       "Consumer channel property",
+			properties: map[string]string{"go.events.channel.enable": "false"},
+			err:        `property "go.events.channel.enable" is managed by dswatcher`,
+		},
+		{
+			name:       "Application rebalance property",
+			properties: map[string]string{"go.application.rebalance.enable": "false"},
+			err:        `property "go.application.rebalance.enable" is managed by dswatcher`,
+		},
+	}
+	for _, key := range rdKafkaFileProperties {
+		testCases = append(testCases, testCase{
+			name:       "Unreadable " + key,
+			properties: map[string]string{key: missing},
+			err:        key + ": open " + missing + ": no such file or directory",
+		})
+	}
+
+	for _, tc := range testCases {
+		attributes := &rdkafka.ConfigMap{}
+		err := setRdKafkaProperties(attributes, tc.properties)
+
+		if len(tc.err) > 0 {
+			assert.EqualError(t, err, tc.err, tc.name)
+			continue
+		}
+
+		assert.NoError(t, err, tc.name)
+		for key, value := range tc.properties {
+			assert.Equal(t, value, (*attributes)[key], tc.name)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+// Service for allowing new sensors to send flow based on a serial number.
+// Copyright (C) 2017 ENEO Tecnologia SL
+// Author: Diego Fernández Barrear <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package audit
+
+import (
+	"github.com/redBorder/dswatcher/internal/updater"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.New()
+
+// Multi sends the audit events to several auditors.
+type Multi []updater.Auditor
+
+// Audit records the event on every auditor.
+func (m Multi) Audit(event updater.AuditEvent) {
+	for _, auditor := range m {
+		auditor.Audit(event)
+	}
+}
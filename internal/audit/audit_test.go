@@ -0,0 +1,42 @@
+// Service for allowing new sensors to send flow based on a serial number.
+// Copyright (C) 2017 ENEO Tecnologia SL
+// Author: Diego Fernández Barrear <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package audit
+
+import (
+	"testing"
+
+	"github.com/redBorder/dswatcher/internal/updater"
+	"github.com/stretchr/testify/assert"
+)
+
+type recorder struct {
+	events []updater.AuditEvent
+}
+
+func (r *recorder) Audit(event updater.AuditEvent) {
+	r.events = append(r.events, event)
+}
+
+func TestMulti(t *testing.T) {
+	first, second := &recorder{}, &recorder{}
+
+	Multi{first, second}.Audit(updater.AuditEvent{Node: "sensor-a"})
+
+	assert.Len(t, first.events, 1)
+	assert.Len(t, second.events, 1)
+}
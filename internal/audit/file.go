@@ -0,0 +1,154 @@
+// Service for allowing new sensors to send flow based on a serial number.
+// Copyright (C) 2017 ENEO Tecnologia SL
+// Author: Diego Fernández Barrear <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/redBorder/dswatcher/internal/updater"
+)
+
+// FileAuditor writes the audit events to a file as JSON lines. The file is
+// rotated when it reaches a maximum size, keeping a number of old files named
+// "<path>.1" (the newest) to "<path>.<MaxBackups>" (the oldest).
+type FileAuditor struct {
+	mu   sync.Mutex
+	file *os.File
+	size int64
+
+	path       string
+	maxSize    int64
+	maxBackups int
+}
+
+// NewFileAuditor opens the audit file, creating it if it doesn't exist. New
+// events are appended to the existing ones. A maxSize of zero disables the
+// rotation.
+func NewFileAuditor(path string, maxSize int64, maxBackups int) (*FileAuditor, error) {
+	a := &FileAuditor{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	if err := a.open(); err != nil {
+		return nil, errors.New("Error opening audit file: " + err.Error())
+	}
+
+	return a, nil
+}
+
+// Audit appends an event to the file. Errors are logged, so a failure writing
+// the audit trail doesn't stop the sensors from being updated.
+func (a *FileAuditor) Audit(event updater.AuditEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Errorln("Error encoding audit event: " + err.Error())
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil {
+		if err := a.open(); err != nil {
+			log.Errorln("Error opening audit file: " + err.Error())
+			return
+		}
+	}
+
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			log.Errorln("Error rotating audit file: " + err.Error())
+			if a.file == nil {
+				return
+			}
+		}
+	}
+
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		log.Errorln("Error writing audit event: " + err.Error())
+	}
+}
+
+// Close closes the audit file.
+func (a *FileAuditor) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil {
+		return nil
+	}
+
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+// open opens the audit file for appending.
+func (a *FileAuditor) open() error {
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+// rotate shifts the old files, moves the current file to "<path>.1" and opens
+// a new one. The oldest file is removed if there are too many.
+func (a *FileAuditor) rotate() error {
+	a.file.Close()
+	a.file = nil
+
+	if a.maxBackups > 0 {
+		for i := a.maxBackups - 1; i > 0; i-- {
+			err := os.Rename(a.backup(i), a.backup(i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+
+		if err := os.Rename(a.path, a.backup(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(a.path); err != nil {
+		return err
+	}
+
+	return a.open()
+}
+
+func (a *FileAuditor) backup(n int) string {
+	return fmt.Sprintf("%s.%d", a.path, n)
+}
@@ -0,0 +1,125 @@
+// Service for allowing new sensors to send flow based on a serial number.
+// Copyright (C) 2017 ENEO Tecnologia SL
+// Author: Diego Fernández Barrear <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/redBorder/dswatcher/internal/updater"
+	"github.com/stretchr/testify/assert"
+)
+
+func readEvents(t *testing.T, path string) []updater.AuditEvent {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var events []updater.AuditEvent
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event updater.AuditEvent
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		events = append(events, event)
+	}
+
+	return events
+}
+
+func TestFileAuditor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	a, err := NewFileAuditor(path, 0, 0)
+	assert.NoError(t, err)
+
+	now := time.Date(2017, 6, 1, 10, 0, 0, 0, time.UTC)
+	a.Audit(updater.AuditEvent{
+		Timestamp: now,
+		Node:      "sensor-a",
+		Attribute: "org/blocked",
+		OldValue:  false,
+		NewValue:  true,
+		Trigger:   "kafka limits/0@12",
+	})
+	assert.NoError(t, a.Close())
+
+	// Events are appended when the file is opened again
+	a, err = NewFileAuditor(path, 0, 0)
+	assert.NoError(t, err)
+	a.Audit(updater.AuditEvent{Node: "sensor-b"})
+	assert.NoError(t, a.Close())
+
+	events := readEvents(t, path)
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, "sensor-a", events[0].Node)
+		assert.Equal(t, "org/blocked", events[0].Attribute)
+		assert.Equal(t, false, events[0].OldValue)
+		assert.Equal(t, true, events[0].NewValue)
+		assert.Equal(t, "kafka limits/0@12", events[0].Trigger)
+		assert.True(t, now.Equal(events[0].Timestamp))
+		assert.Equal(t, "sensor-b", events[1].Node)
+	}
+}
+
+func TestFileAuditorRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	line, _ := json.Marshal(updater.AuditEvent{Node: "sensor-0"})
+	size := int64(len(line) + 1)
+
+	// Two events fit on each file
+	a, err := NewFileAuditor(path, 2*size, 2)
+	assert.NoError(t, err)
+	defer a.Close()
+
+	for i := 0; i < 7; i++ {
+		a.Audit(updater.AuditEvent{Node: "sensor-" + string('0'+rune(i))})
+	}
+
+	nodes := func(path string) []string {
+		var nodes []string
+		for _, event := range readEvents(t, path) {
+			nodes = append(nodes, event.Node)
+		}
+		return nodes
+	}
+
+	assert.Equal(t, []string{"sensor-6"}, nodes(path))
+	assert.Equal(t, []string{"sensor-4", "sensor-5"}, nodes(path+".1"))
+	assert.Equal(t, []string{"sensor-2", "sensor-3"}, nodes(path+".2"))
+
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,95 @@
+// Service for allowing new sensors to send flow based on a serial number.
+// Copyright (C) 2017 ENEO Tecnologia SL
+// Author: Diego Fernández Barrear <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package audit
+
+import (
+	"encoding/json"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/redBorder/dswatcher/internal/updater"
+)
+
+// RdKafkaProducer is an interface for rdkafka producer. Used for mocking
+// purposes.
+type RdKafkaProducer interface {
+	ProduceChannel() chan *kafka.Message
+	Events() chan kafka.Event
+	Flush(timeoutMs int) int
+	Close()
+}
+
+// KafkaAuditor sends the audit events to a Kafka topic as JSON messages. The
+// messages are keyed by node name, so the events of a node keep their order.
+type KafkaAuditor struct {
+	producer RdKafkaProducer
+	topic    string
+}
+
+// NewKafkaAuditor creates an auditor that sends the events to a topic. Delivery
+// errors are logged.
+func NewKafkaAuditor(producer RdKafkaProducer, topic string) *KafkaAuditor {
+	a := &KafkaAuditor{
+		producer: producer,
+		topic:    topic,
+	}
+
+	go func() {
+		for ev := range producer.Events() {
+			switch e := ev.(type) {
+			case *kafka.Message:
+				if e.TopicPartition.Error != nil {
+					log.Errorln("Error sending audit event: " +
+						e.TopicPartition.Error.Error())
+				}
+
+			case kafka.Error:
+				log.Errorln("Audit producer error: " + e.String())
+			}
+		}
+	}()
+
+	return a
+}
+
+// Audit sends an event to the topic.
+func (a *KafkaAuditor) Audit(event updater.AuditEvent) {
+	value, err := json.Marshal(event)
+	if err != nil {
+		log.Errorln("Error encoding audit event: " + err.Error())
+		return
+	}
+
+	a.producer.ProduceChannel() <- &kafka.Message{
+		TopicPartition: kafka.TopicPartition{
+			Topic:     &a.topic,
+			Partition: kafka.PartitionAny,
+		},
+		Key:   []byte(event.Node),
+		Value: value,
+	}
+}
+
+// Close waits until the pending events are sent, for up to the given time,
+// and closes the producer.
+func (a *KafkaAuditor) Close(timeoutMs int) {
+	if remaining := a.producer.Flush(timeoutMs); remaining > 0 {
+		log.Warnf("%d audit events not sent", remaining)
+	}
+
+	a.producer.Close()
+}
@@ -0,0 +1,83 @@
+// Service for allowing new sensors to send flow based on a serial number.
+// Copyright (C) 2017 ENEO Tecnologia SL
+// Author: Diego Fernández Barrear <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package audit
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/redBorder/dswatcher/internal/updater"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type MockRdKafkaProducer struct {
+	mock.Mock
+	produce chan *kafka.Message
+	events  chan kafka.Event
+}
+
+func (p *MockRdKafkaProducer) ProduceChannel() chan *kafka.Message {
+	return p.produce
+}
+
+func (p *MockRdKafkaProducer) Events() chan kafka.Event {
+	return p.events
+}
+
+func (p *MockRdKafkaProducer) Flush(timeoutMs int) int {
+	args := p.Called(timeoutMs)
+	return args.Int(0)
+}
+
+func (p *MockRdKafkaProducer) Close() {
+	p.Called()
+	close(p.events)
+}
+
+func TestKafkaAuditor(t *testing.T) {
+	producer := &MockRdKafkaProducer{
+		produce: make(chan *kafka.Message, 1),
+		events:  make(chan kafka.Event),
+	}
+	producer.On("Flush", 1000).Return(0)
+	producer.On("Close").Return()
+
+	a := NewKafkaAuditor(producer, "audit")
+	a.Audit(updater.AuditEvent{
+		Node:      "sensor-a",
+		Attribute: "org/ipaddress",
+		NewValue:  "10.0.0.1",
+		Trigger:   "netflow exporter 10.0.0.1",
+	})
+
+	message := <-producer.produce
+	assert.Equal(t, "audit", *message.TopicPartition.Topic)
+	assert.Equal(t, kafka.PartitionAny, message.TopicPartition.Partition)
+	assert.Equal(t, []byte("sensor-a"), message.Key)
+
+	var event updater.AuditEvent
+	assert.NoError(t, json.Unmarshal(message.Value, &event))
+	assert.Equal(t, "org/ipaddress", event.Attribute)
+	assert.Equal(t, "10.0.0.1", event.NewValue)
+	assert.Equal(t, "netflow exporter 10.0.0.1", event.Trigger)
+
+	a.Close(1000)
+	producer.AssertExpectations(t)
+}
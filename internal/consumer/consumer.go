@@ -17,29 +17,73 @@
 
 package consumer
 
+import "fmt"
+
 // Message can be either an UUID to be blocked or a ResetSignal
 type Message interface{}
 
+// Origin identifies the Kafka message a message comes from
+type Origin struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+}
+
+// String returns the origin as "topic/partition@offset"
+func (o Origin) String() string {
+	return fmt.Sprintf("%s/%d@%d", o.Topic, o.Partition, o.Offset)
+}
+
+// LimitsMessage contains a message received from the limits topics, the type
+// of the alert (e.g. "limit_reached") and the Kafka message it comes from
+type LimitsMessage struct {
+	Message
+	Type   string
+	Origin Origin
+}
+
 // BlockOrganization identifies the organization that reached the limit
 type BlockOrganization string
 
-// AllowLicense reports a valid license.
-type AllowLicense struct {
-	License string
+// UnblockOrganization identifies the organization whose limit has been reset
+type UnblockOrganization string
+
+// LimitWarning reports an organization that is close to reach its limit
+type LimitWarning struct {
+	Organization string
+	CurrentBytes int64
+	Limit        int64
+}
+
+// AllowedLicenses contains the full set of valid licenses. Sensors without
+// one of these licenses should be blocked and the rest unblocked.
+type AllowedLicenses struct {
+	Licenses []string
 }
 
-// ResetSensors notifies that sensors from a given organization should be
-// unblocked.
-type ResetSensors struct{}
+// BlockSensor identifies a single sensor to be blocked. The sensor is
+// identified by its UUID or, if empty, by its serial number.
+type BlockSensor struct {
+	UUID         string
+	SerialNumber string
+}
+
+// UnblockSensor identifies a single sensor to be unblocked. The sensor is
+// identified by its UUID or, if empty, by its serial number.
+type UnblockSensor struct {
+	UUID         string
+	SerialNumber string
+}
 
 // FlowData contains the IP address of the Netflow exporter and the flow itself
 type FlowData struct {
-	IP   uint32
-	Data []byte
+	IP     uint32
+	Data   []byte
+	Origin Origin
 }
 
 // NetflowConsumer gets an IP address and Netflow data from a resource
 type NetflowConsumer interface {
 	ConsumeNetflow() (messages chan FlowData, events chan string)
-	ConsumeLimits() (messages chan Message, events chan string)
+	ConsumeLimits() (messages chan LimitsMessage, events chan string)
 }
@@ -19,22 +19,14 @@ package consumer
 
 import (
 	"encoding/binary"
-	"encoding/json"
 	"errors"
+	"fmt"
+	"sync"
+	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 )
 
-type signal struct {
-	Monitor      string   `yaml:"monitor"`
-	Type         string   `yaml:"type"`
-	UUID         string   `yaml:"uuid"`
-	CurrentBytes string   `yaml:"current_bytes"`
-	Limit        int64    `yaml:"limit"`
-	Timestamp    int64    `yaml:"timestamp"`
-	Licenses     []string `yaml:"licenses"`
-}
-
 ///////////////
 //Interfaces //
 ///////////////
@@ -53,12 +45,22 @@ type RdKafkaConsumer interface {
 // KakfaConsumerConfig //
 /////////////////////////
 
-// KakfaConsumerConfig contains the configuration for a Kafka Consumer.
+// KakfaConsumerConfig contains the configuration for a Kafka Consumer. The
+// Netflow and limits consumers are independent and may be connected to
+// different Kafka clusters.
 type KakfaConsumerConfig struct {
 	NetflowConsumer RdKafkaConsumer
 	LimitsConsumer  RdKafkaConsumer
 	NetflowTopics   []string
 	LimitsTopics    []string
+
+	// LimitsMaxAge is the maximum age of a limits message. Older messages are
+	// discarded. Zero disables the check.
+	LimitsMaxAge time.Duration
+
+	// LimitsAllowUntimestamped accepts the limits messages without timestamp,
+	// skipping the max age and ordering checks. They are discarded otherwise.
+	LimitsAllowUntimestamped bool
 }
 
 ///////////////////
@@ -68,6 +70,8 @@ type KakfaConsumerConfig struct {
 // KafkaConsumer implements "Consumer" and consumes messages from a Kafka broker
 type KafkaConsumer struct {
 	terminate chan struct{}
+	closeOnce sync.Once
+	running   sync.WaitGroup
 
 	KakfaConsumerConfig
 }
@@ -103,6 +107,7 @@ func NewKafkaConsumer(config KakfaConsumerConfig) (kc *KafkaConsumer, err error)
 func (kc *KafkaConsumer) ConsumeNetflow() (chan FlowData, chan string) {
 	messages := make(chan FlowData)
 	inputMessages, info := receiveLoop(kc.NetflowConsumer, kc.terminate)
+	kc.running.Add(1)
 
 	go func() {
 		for m := range inputMessages {
@@ -111,14 +116,15 @@ func (kc *KafkaConsumer) ConsumeNetflow() (chan FlowData, chan string) {
 				continue
 			}
 			messages <- FlowData{
-				IP:   binary.LittleEndian.Uint32(m.Key),
-				Data: m.Value,
+				IP:     binary.LittleEndian.Uint32(m.Key),
+				Data:   m.Value,
+				Origin: originOf(m),
 			}
 		}
 
 		kc.NetflowConsumer.Close()
 		close(messages)
-		close(kc.terminate)
+		kc.running.Done()
 	}()
 
 	return messages, info
@@ -129,54 +135,97 @@ func (kc *KafkaConsumer) ConsumeNetflow() (chan FlowData, chan string) {
 // notifications from the Kafka broker.
 //
 //   - "limit_reached": All sensors belonging to an organization are blocked.
-//   - "allowed_licenses": All sensors are blocked and the only the sensors
-//     with a valid license are allowed.
-func (kc *KafkaConsumer) ConsumeLimits() (chan Message, chan string) {
-	messages := make(chan Message)
+//   - "limit_warning": An organization is close to its limit.
+//   - "limit_reset": All sensors belonging to an organization are unblocked.
+//   - "allowed_licenses": Only the sensors with one of the licenses are
+//     allowed, the rest are blocked.
+//   - "sensor_blocked": A single sensor, identified by "sensor_uuid" or
+//     "serial_number", is blocked.
+//   - "sensor_unblocked": A single sensor, identified by "sensor_uuid" or
+//     "serial_number", is unblocked.
+//
+// Invalid messages are rejected with the reason sent to the "info" channel.
+// Messages older than the last one applied for the same organization, older
+// than "LimitsMaxAge", or without timestamp unless "LimitsAllowUntimestamped"
+// is set, are discarded.
+func (kc *KafkaConsumer) ConsumeLimits() (chan LimitsMessage, chan string) {
+	messages := make(chan LimitsMessage)
 	inputMessages, info := receiveLoop(kc.LimitsConsumer, kc.terminate)
+	kc.running.Add(1)
 
 	go func() {
-		for m := range inputMessages {
-			var data signal
-			err := json.Unmarshal(m.Value, &data)
+		ordering := newAlertsOrdering(kc.LimitsMaxAge, kc.LimitsAllowUntimestamped)
 
-			// TODO this should be logged as an error
+		for m := range inputMessages {
+			data, err := parseSignal(m.Value)
 			if err != nil {
-				info <- err.Error()
+				info <- "Rejected limits message: " + err.Error()
 				continue
 			}
 
-			switch data.Type {
-			case "limit_reached":
-				messages <- BlockOrganization(data.UUID)
+			scope := data.scope()
+			if err := ordering.accept(scope, data.Timestamp, time.Now()); err != nil {
+				info <- fmt.Sprintf("Discarded %s alert for %q: %s",
+					data.Type, scope, err.Error())
+				continue
+			}
 
-			// If the license/s are empty or expired
-			case "unknown_uuid":
-				messages <- BlockOrganization(data.UUID)
+			var message Message
 
-			case "allowed_licenses":
-				messages <- ResetSensors{}
-				for _, license := range data.Licenses {
-					messages <- AllowLicense{license}
+			switch data.Type {
+			// "unknown_uuid" is received if the license/s are empty or expired
+			case typeLimitReached, typeUnknownUUID:
+				message = BlockOrganization(data.UUID)
+
+			case typeLimitWarning:
+				currentBytes, _ := data.CurrentBytes.Int64()
+				message = LimitWarning{
+					Organization: data.UUID,
+					CurrentBytes: currentBytes,
+					Limit:        data.Limit,
 				}
 
-			default:
-				info <- "Unknown alert received"
+			case typeLimitReset:
+				message = UnblockOrganization(data.UUID)
+
+			case typeAllowedLicenses:
+				message = AllowedLicenses{data.Licenses}
+
+			case typeSensorBlocked:
+				message = BlockSensor{data.SensorUUID, data.SerialNumber}
+
+			case typeSensorUnblocked:
+				message = UnblockSensor{data.SensorUUID, data.SerialNumber}
 			}
+
+			messages <- LimitsMessage{message, data.Type, originOf(m)}
 		}
 
 		kc.LimitsConsumer.Close()
 		close(messages)
-		close(kc.terminate)
+		kc.running.Done()
 	}()
 
 	return messages, info
 }
 
-// Close terminates the rdkafka consumer
+// Close terminates the rdkafka consumers and waits until they are closed
 func (kc *KafkaConsumer) Close() {
-	kc.terminate <- struct{}{}
-	<-kc.terminate
+	kc.closeOnce.Do(func() { close(kc.terminate) })
+	kc.running.Wait()
+}
+
+// originOf returns the topic, partition and offset of a Kafka message.
+func originOf(m *kafka.Message) Origin {
+	origin := Origin{
+		Partition: m.TopicPartition.Partition,
+		Offset:    int64(m.TopicPartition.Offset),
+	}
+	if m.TopicPartition.Topic != nil {
+		origin.Topic = *m.TopicPartition.Topic
+	}
+
+	return origin
 }
 
 func receiveLoop(
@@ -306,7 +306,13 @@ func TestLimitsConsumer(t *testing.T) {
 			rdConsumer.On("Events").Return(events)
 			rdConsumer.On("Close").Return(nil)
 
+			topic := "limits"
 			events <- &kafka.Message{
+				TopicPartition: kafka.TopicPartition{
+					Topic:     &topic,
+					Partition: 2,
+					Offset:    42,
+				},
 				Value: []byte(
 					`{
 						 "monitor": "alert",
@@ -318,7 +324,11 @@ func TestLimitsConsumer(t *testing.T) {
 
 			Convey("The message should be consumed", func() {
 				messages, _ := consumer.ConsumeLimits()
-				msg := <-messages
+				received := <-messages
+				msg := received.Message
+
+				So(received.Origin.String(), ShouldEqual, "limits/2@42")
+				So(received.Type, ShouldEqual, "limit_reached")
 
 				uuid, ok := msg.(BlockOrganization)
 				So(ok, ShouldBeTrue)
@@ -349,19 +359,174 @@ func TestLimitsConsumer(t *testing.T) {
 
 			Convey("The message should be consumed", func() {
 				messages, _ := consumer.ConsumeLimits()
-				msg := <-messages
+				msg := (<-messages).Message
 
-				_, ok := msg.(ResetSensors)
+				licenses, ok := msg.(AllowedLicenses)
 				So(ok, ShouldBeTrue)
+				So(licenses.Licenses, ShouldResemble, []string{
+					"7416ba90-926b-475f-a26e-53fe1a7e3c36",
+					"12341223-926b-475f-a26e-53fe1a7e3c36",
+				})
+
+				consumer.Close()
+				rdConsumer.AssertExpectations(t)
+			})
+		})
+
+		Convey("When sensor blocked and unblocked messages are received", func() {
+			events := make(chan kafka.Event, 2)
+			rdConsumer.On("Events").Return(events)
+			rdConsumer.On("Close").Return(nil)
+
+			events <- &kafka.Message{
+				Value: []byte(
+					`{
+						 "monitor": "alert",
+						 "type": "sensor_blocked",
+						 "sensor_uuid": "7416ba90-926b-475f-a26e-53fe1a7e3c36",
+						 "timestamp": 1489057426
+					 }`),
+			}
+			events <- &kafka.Message{
+				Value: []byte(
+					`{
+						 "monitor": "alert",
+						 "type": "sensor_unblocked",
+						 "serial_number": "888888",
+						 "timestamp": 1489057426
+					 }`),
+			}
+
+			Convey("The messages should be consumed", func() {
+				messages, _ := consumer.ConsumeLimits()
+
+				msg := (<-messages).Message
+				block, ok := msg.(BlockSensor)
+				So(ok, ShouldBeTrue)
+				So(block.UUID, ShouldEqual, "7416ba90-926b-475f-a26e-53fe1a7e3c36")
+				So(block.SerialNumber, ShouldBeEmpty)
+
+				msg = (<-messages).Message
+				unblock, ok := msg.(UnblockSensor)
+				So(ok, ShouldBeTrue)
+				So(unblock.UUID, ShouldBeEmpty)
+				So(unblock.SerialNumber, ShouldEqual, "888888")
+
+				consumer.Close()
+				rdConsumer.AssertExpectations(t)
+			})
+		})
 
-				msg = <-messages
-				uuid, ok := msg.(AllowLicense)
+		Convey("When limit warning and limit reset messages are received", func() {
+			events := make(chan kafka.Event, 2)
+			rdConsumer.On("Events").Return(events)
+			rdConsumer.On("Close").Return(nil)
+
+			events <- &kafka.Message{
+				Value: []byte(
+					`{
+						 "version": 1,
+						 "monitor": "alert",
+						 "type": "limit_warning",
+						 "uuid": "7416ba90-926b-475f-a26e-53fe1a7e3c36",
+						 "current_bytes": 900,
+						 "limit": 1000,
+						 "timestamp": 1489057426
+					 }`),
+			}
+			events <- &kafka.Message{
+				Value: []byte(
+					`{
+						 "version": 1,
+						 "monitor": "alert",
+						 "type": "limit_reset",
+						 "uuid": "7416ba90-926b-475f-a26e-53fe1a7e3c36",
+						 "timestamp": 1489057426
+					 }`),
+			}
+
+			Convey("The messages should be consumed", func() {
+				messages, _ := consumer.ConsumeLimits()
+
+				msg := (<-messages).Message
+				warning, ok := msg.(LimitWarning)
 				So(ok, ShouldBeTrue)
-				So(uuid.License, ShouldEqual, "7416ba90-926b-475f-a26e-53fe1a7e3c36")
-				msg = <-messages
-				uuid, ok = msg.(AllowLicense)
+				So(warning, ShouldResemble, LimitWarning{
+					Organization: "7416ba90-926b-475f-a26e-53fe1a7e3c36",
+					CurrentBytes: 900,
+					Limit:        1000,
+				})
+
+				msg = (<-messages).Message
+				uuid, ok := msg.(UnblockOrganization)
+				So(ok, ShouldBeTrue)
+				So(uuid, ShouldEqual, "7416ba90-926b-475f-a26e-53fe1a7e3c36")
+
+				consumer.Close()
+				rdConsumer.AssertExpectations(t)
+			})
+		})
+
+		Convey("When an outdated limit reached message is received", func() {
+			events := make(chan kafka.Event, 2)
+			rdConsumer.On("Events").Return(events)
+			rdConsumer.On("Close").Return(nil)
+
+			events <- &kafka.Message{
+				Value: []byte(
+					`{
+						 "monitor": "alert",
+						 "type": "limit_reached",
+						 "uuid": "7416ba90-926b-475f-a26e-53fe1a7e3c36",
+						 "timestamp": 1489057426
+					 }`),
+			}
+			events <- &kafka.Message{
+				Value: []byte(
+					`{
+						 "monitor": "alert",
+						 "type": "limit_reached",
+						 "uuid": "7416ba90-926b-475f-a26e-53fe1a7e3c36",
+						 "timestamp": 1489050000
+					 }`),
+			}
+
+			Convey("The message should be discarded", func() {
+				messages, info := consumer.ConsumeLimits()
+				msg := (<-messages).Message
+
+				uuid, ok := msg.(BlockOrganization)
 				So(ok, ShouldBeTrue)
-				So(uuid.License, ShouldEqual, "12341223-926b-475f-a26e-53fe1a7e3c36")
+				So(uuid, ShouldEqual, "7416ba90-926b-475f-a26e-53fe1a7e3c36")
+
+				report := <-info
+				So(report, ShouldStartWith, "Discarded limit_reached alert")
+
+				consumer.Close()
+				rdConsumer.AssertExpectations(t)
+			})
+		})
+
+		Convey("When a limit reached message without timestamp is received", func() {
+			events := make(chan kafka.Event, 1)
+			rdConsumer.On("Events").Return(events)
+			rdConsumer.On("Close").Return(nil)
+
+			events <- &kafka.Message{
+				Value: []byte(
+					`{
+						 "monitor": "alert",
+						 "type": "limit_reached",
+						 "uuid": "7416ba90-926b-475f-a26e-53fe1a7e3c36"
+					 }`),
+			}
+
+			Convey("The message should be discarded", func() {
+				_, info := consumer.ConsumeLimits()
+				report := <-info
+
+				So(report, ShouldEqual, `Discarded limit_reached alert for `+
+					`"7416ba90-926b-475f-a26e-53fe1a7e3c36": alert has no timestamp`)
 
 				consumer.Close()
 				rdConsumer.AssertExpectations(t)
@@ -386,7 +551,8 @@ func TestLimitsConsumer(t *testing.T) {
 				_, info := consumer.ConsumeLimits()
 				msg := <-info
 
-				So(msg, ShouldEqual, "Unknown alert received")
+				So(msg, ShouldEqual,
+					`Rejected limits message: unknown type "unknown_message"`)
 
 				consumer.Close()
 				rdConsumer.AssertExpectations(t)
@@ -426,3 +592,66 @@ func TestLimitsConsumerFail(t *testing.T) {
 		})
 	})
 }
+
+func TestNetflowAndLimitsConsumer(t *testing.T) {
+	Convey("Given a consumer for each Kafka cluster", t, func() {
+		nfConsumer := new(RdConsumerMock)
+		limitsConsumer := new(RdConsumerMock)
+
+		nfConsumer.
+			On("SubscribeTopics", []string{"discard"}, mock.AnythingOfType("kafka.RebalanceCb")).
+			Return(nil)
+		limitsConsumer.
+			On("SubscribeTopics", []string{"limits"}, mock.AnythingOfType("kafka.RebalanceCb")).
+			Return(nil)
+
+		consumer, err := NewKafkaConsumer(
+			KakfaConsumerConfig{
+				NetflowConsumer: nfConsumer,
+				NetflowTopics:   []string{"discard"},
+				LimitsConsumer:  limitsConsumer,
+				LimitsTopics:    []string{"limits"},
+			})
+		So(err, ShouldBeNil)
+
+		Convey("When both consumers receive messages", func() {
+			nfEvents := make(chan kafka.Event, 1)
+			nfConsumer.On("Events").Return(nfEvents)
+			nfConsumer.On("Close").Return(nil)
+
+			limitsEvents := make(chan kafka.Event, 1)
+			limitsConsumer.On("Events").Return(limitsEvents)
+			limitsConsumer.On("Close").Return(nil)
+
+			nfEvents <- &kafka.Message{
+				Key:   []byte{0x04, 0x03, 0x02, 0x01},
+				Value: []byte("payload"),
+			}
+			limitsEvents <- &kafka.Message{
+				Value: []byte(`{"type": "limit_reached", "uuid": "abcde", "timestamp": 1489057426}`),
+			}
+
+			Convey("Both messages should be consumed and closed", func() {
+				nfMessages, _ := consumer.ConsumeNetflow()
+				limitsMessages, _ := consumer.ConsumeLimits()
+
+				flow := <-nfMessages
+				So(flow.Data, ShouldResemble, []byte("payload"))
+
+				msg := <-limitsMessages
+				So(msg.Message, ShouldEqual, BlockOrganization("abcde"))
+
+				consumer.Close()
+				consumer.Close()
+
+				_, ok := <-nfMessages
+				So(ok, ShouldBeFalse)
+				_, ok = <-limitsMessages
+				So(ok, ShouldBeFalse)
+
+				nfConsumer.AssertExpectations(t)
+				limitsConsumer.AssertExpectations(t)
+			})
+		})
+	})
+}
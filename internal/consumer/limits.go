@@ -0,0 +1,147 @@
+// Service for allowing new sensors to send flow based on a serial number.
+// Copyright (C) 2017 ENEO Tecnologia SL
+// Author: Diego Fernández Barrera <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package consumer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// limitsSchemaVersion is the latest supported version of the limits messages
+// schema. Messages without "version" are handled as version 0, the format used
+// before the schema was versioned, where "timestamp" is optional.
+const limitsSchemaVersion = 1
+
+// Limits message types
+const (
+	typeLimitReached    = "limit_reached"
+	typeLimitWarning    = "limit_warning"
+	typeLimitReset      = "limit_reset"
+	typeUnknownUUID     = "unknown_uuid"
+	typeAllowedLicenses = "allowed_licenses"
+	typeSensorBlocked   = "sensor_blocked"
+	typeSensorUnblocked = "sensor_unblocked"
+)
+
+// signal is a limits message as received from Kafka:
+//
+//	{
+//	  "version": 1,
+//	  "monitor": "alert",
+//	  "type": "limit_reached",
+//	  "uuid": "7416ba90-926b-475f-a26e-53fe1a7e3c36",
+//	  "current_bytes": 1200,
+//	  "limit": 1000,
+//	  "timestamp": 1489057426
+//	}
+//
+// "uuid" is the organization UUID (or "*" for all organizations) and is
+// required by "limit_reached", "limit_warning", "limit_reset" and
+// "unknown_uuid". "allowed_licenses" requires "licenses" and "sensor_blocked"
+// and "sensor_unblocked" require "sensor_uuid" or "serial_number".
+type signal struct {
+	Version      int         `json:"version"`
+	Monitor      string      `json:"monitor"`
+	Type         string      `json:"type"`
+	UUID         string      `json:"uuid"`
+	CurrentBytes json.Number `json:"current_bytes"`
+	Limit        int64       `json:"limit"`
+	Timestamp    int64       `json:"timestamp"`
+	Licenses     []string    `json:"licenses"`
+	SensorUUID   string      `json:"sensor_uuid"`
+	SerialNumber string      `json:"serial_number"`
+}
+
+// parseSignal decodes and validates a limits message. Unknown fields are not
+// allowed.
+func parseSignal(raw []byte) (*signal, error) {
+	var data signal
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&data); err != nil {
+		return nil, errors.New("invalid JSON: " + err.Error())
+	}
+
+	if err := data.validate(); err != nil {
+		return nil, err
+	}
+
+	return &data, nil
+}
+
+func (s *signal) validate() error {
+	if s.Version < 0 || s.Version > limitsSchemaVersion {
+		return fmt.Errorf("unsupported version %d", s.Version)
+	}
+
+	if s.Version > 0 && s.Timestamp <= 0 {
+		return errors.New("missing timestamp")
+	}
+
+	if len(s.CurrentBytes) > 0 {
+		if _, err := s.CurrentBytes.Int64(); err != nil {
+			return fmt.Errorf("invalid current_bytes %q", s.CurrentBytes)
+		}
+	}
+
+	switch s.Type {
+	case typeLimitReached, typeLimitWarning, typeLimitReset, typeUnknownUUID:
+		if len(s.UUID) == 0 {
+			return fmt.Errorf("missing uuid for %s", s.Type)
+		}
+
+	case typeAllowedLicenses:
+		if s.Licenses == nil {
+			return fmt.Errorf("missing licenses for %s", s.Type)
+		}
+
+	case typeSensorBlocked, typeSensorUnblocked:
+		if len(s.SensorUUID) == 0 && len(s.SerialNumber) == 0 {
+			return fmt.Errorf("missing sensor_uuid or serial_number for %s", s.Type)
+		}
+
+	case "":
+		return errors.New("missing type")
+
+	default:
+		return fmt.Errorf("unknown type %q", s.Type)
+	}
+
+	return nil
+}
+
+// scope returns the organization or sensor affected by the message, used to
+// order messages.
+func (s *signal) scope() string {
+	switch s.Type {
+	case typeAllowedLicenses:
+		return globalScope
+
+	case typeSensorBlocked, typeSensorUnblocked:
+		if len(s.SensorUUID) > 0 {
+			return "sensor_uuid/" + s.SensorUUID
+		}
+		return "serial_number/" + s.SerialNumber
+
+	default:
+		return s.UUID
+	}
+}
@@ -0,0 +1,82 @@
+// Service for allowing new sensors to send flow based on a serial number.
+// Copyright (C) 2017 ENEO Tecnologia SL
+// Author: Diego Fernández Barrera <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package consumer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSignal(t *testing.T) {
+	data, err := parseSignal([]byte(`{
+		"version": 1,
+		"monitor": "alert",
+		"type": "limit_warning",
+		"uuid": "abcde",
+		"current_bytes": "900",
+		"limit": 1000,
+		"timestamp": 1489057426
+	}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "limit_warning", data.Type)
+	assert.Equal(t, "abcde", data.UUID)
+	assert.Equal(t, int64(1000), data.Limit)
+	assert.Equal(t, "abcde", data.scope())
+
+	currentBytes, err := data.CurrentBytes.Int64()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(900), currentBytes)
+}
+
+func TestParseSignalLegacy(t *testing.T) {
+	data, err := parseSignal([]byte(`{"type": "limit_reset", "uuid": "abcde"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, data.Version)
+
+	data, err = parseSignal([]byte(`{"type": "allowed_licenses", "licenses": []}`))
+	assert.NoError(t, err)
+	assert.Equal(t, globalScope, data.scope())
+
+	data, err = parseSignal([]byte(`{"type": "sensor_blocked", "serial_number": "888888"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "serial_number/888888", data.scope())
+}
+
+func TestParseSignalRejected(t *testing.T) {
+	rejected := map[string]string{
+		`{"type": "limit_reached", "uuid": "abcde"`:                    "invalid JSON",
+		`{"type": "limit_reached", "uuid": "abcde", "foo": "bar"}`:     "invalid JSON",
+		`{"type": "limit_reached", "uuid": "abcde", "version": 2}`:     "unsupported version 2",
+		`{"type": "limit_reached", "uuid": "abcde", "version": 1}`:     "missing timestamp",
+		`{"type": "limit_reached"}`:                                    "missing uuid for limit_reached",
+		`{"type": "limit_warning", "uuid": "a", "current_bytes": "x"}`: "invalid JSON",
+		`{"type": "limit_warning", "uuid": "a", "current_bytes": 1.5}`: "invalid current_bytes \"1.5\"",
+		`{"type": "allowed_licenses"}`:                                 "missing licenses for allowed_licenses",
+		`{"type": "sensor_unblocked"}`:                                 "missing sensor_uuid or serial_number for sensor_unblocked",
+		`{"uuid": "abcde"}`:                                            "missing type",
+		`{"type": "unknown_message"}`:                                  "unknown type \"unknown_message\"",
+	}
+
+	for raw, reason := range rejected {
+		_, err := parseSignal([]byte(raw))
+		if assert.Error(t, err, raw) {
+			assert.Contains(t, err.Error(), reason, raw)
+		}
+	}
+}
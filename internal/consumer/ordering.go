@@ -0,0 +1,86 @@
+// Service for allowing new sensors to send flow based on a serial number.
+// Copyright (C) 2017 ENEO Tecnologia SL
+// Author: Diego Fernández Barrera <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// globalScope is the scope of the alerts that affect every organization.
+const globalScope = "*"
+
+// alertsOrdering keeps the timestamp of the last alert applied for every
+// organization so older alerts (e.g. replayed after a consumer group reset)
+// can be discarded.
+type alertsOrdering struct {
+	maxAge           time.Duration
+	allowUntimestamp bool
+	global           int64
+	organizations    map[string]int64
+}
+
+func newAlertsOrdering(maxAge time.Duration, allowUntimestamp bool) *alertsOrdering {
+	return &alertsOrdering{
+		maxAge:           maxAge,
+		allowUntimestamp: allowUntimestamp,
+		organizations:    make(map[string]int64),
+	}
+}
+
+// accept checks if an alert for the given scope (an organization UUID or
+// globalScope) with the given timestamp (seconds since epoch) should be
+// applied. If so, the alert is recorded as the last one applied for that
+// scope. Alerts without timestamp can't be ordered, so they are rejected
+// unless allowUntimestamp is set, in which case they are always accepted.
+func (o *alertsOrdering) accept(scope string, timestamp int64, now time.Time) error {
+	if timestamp <= 0 {
+		if o.allowUntimestamp {
+			return nil
+		}
+
+		return errors.New("alert has no timestamp")
+	}
+
+	if o.maxAge > 0 {
+		age := now.Sub(time.Unix(timestamp, 0))
+		if age > o.maxAge {
+			return fmt.Errorf("alert is %s old (max age %s)", age, o.maxAge)
+		}
+	}
+
+	if timestamp < o.global {
+		return fmt.Errorf("alert is older than the last global change (%d < %d)",
+			timestamp, o.global)
+	}
+
+	if scope == globalScope {
+		o.global = timestamp
+		return nil
+	}
+
+	if last := o.organizations[scope]; timestamp < last {
+		return fmt.Errorf("alert is older than the last change (%d < %d)",
+			timestamp, last)
+	}
+
+	o.organizations[scope] = timestamp
+
+	return nil
+}
@@ -0,0 +1,73 @@
+// Service for allowing new sensors to send flow based on a serial number.
+// Copyright (C) 2017 ENEO Tecnologia SL
+// Author: Diego Fernández Barrera <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package consumer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlertsOrderingByOrganization(t *testing.T) {
+	ordering := newAlertsOrdering(0, false)
+	now := time.Unix(2000, 0)
+
+	assert.NoError(t, ordering.accept("abcde", 200, now))
+	assert.NoError(t, ordering.accept("abcde", 200, now))
+	assert.Error(t, ordering.accept("abcde", 100, now))
+	assert.NoError(t, ordering.accept("fghij", 100, now))
+	assert.NoError(t, ordering.accept("abcde", 300, now))
+}
+
+func TestAlertsOrderingGlobal(t *testing.T) {
+	ordering := newAlertsOrdering(0, false)
+	now := time.Unix(2000, 0)
+
+	assert.NoError(t, ordering.accept("abcde", 200, now))
+	assert.NoError(t, ordering.accept(globalScope, 500, now))
+	assert.Error(t, ordering.accept("fghij", 400, now))
+	assert.Error(t, ordering.accept(globalScope, 400, now))
+	assert.NoError(t, ordering.accept("fghij", 600, now))
+}
+
+func TestAlertsOrderingMaxAge(t *testing.T) {
+	ordering := newAlertsOrdering(time.Minute, false)
+	now := time.Unix(2000, 0)
+
+	assert.Error(t, ordering.accept("abcde", 1000, now))
+	assert.NoError(t, ordering.accept("abcde", 1990, now))
+}
+
+func TestAlertsOrderingWithoutTimestamp(t *testing.T) {
+	ordering := newAlertsOrdering(time.Minute, false)
+	now := time.Unix(2000, 0)
+
+	assert.NoError(t, ordering.accept("abcde", 1990, now))
+	assert.Error(t, ordering.accept("abcde", 0, now))
+	assert.Error(t, ordering.accept(globalScope, -1, now))
+}
+
+func TestAlertsOrderingAllowUntimestamped(t *testing.T) {
+	ordering := newAlertsOrdering(time.Minute, true)
+	now := time.Unix(2000, 0)
+
+	assert.NoError(t, ordering.accept("abcde", 1990, now))
+	assert.NoError(t, ordering.accept("abcde", 0, now))
+	assert.Error(t, ordering.accept("abcde", 1980, now))
+}
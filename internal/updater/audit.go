@@ -0,0 +1,91 @@
+// Service for allowing new sensors to send flow based on a serial number.
+// Copyright (C) 2017 ENEO Tecnologia SL
+// Author: Diego Fernández Barrear <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package updater
+
+import (
+	"reflect"
+	"time"
+)
+
+// Triggers for the changes that are not caused by a message.
+const (
+	TriggerLicenseExpired = "license expired"
+	TriggerLicenseRenewed = "license renewed"
+	TriggerDefaultValue   = "default value"
+	TriggerProvisioning   = "sensor provisioned"
+	TriggerApproval       = "sensor approved"
+)
+
+// AuditEvent is a change of an attribute of a node on Chef.
+type AuditEvent struct {
+	Timestamp time.Time   `json:"timestamp"`
+	Node      string      `json:"node"`
+	Attribute string      `json:"attribute"`
+	OldValue  interface{} `json:"old_value"`
+	NewValue  interface{} `json:"new_value"`
+	Trigger   string      `json:"trigger"`
+}
+
+// Auditor records the changes made on the nodes.
+type Auditor interface {
+	Audit(event AuditEvent)
+}
+
+// attributeChange is the new value of an attribute and the reason why it was
+// changed.
+type attributeChange struct {
+	value   interface{}
+	trigger string
+}
+
+// newChanges returns the changes of the given attributes with the same
+// trigger.
+func newChanges(values map[string]interface{},
+	trigger string) map[string]attributeChange {
+	changes := make(map[string]attributeChange, len(values))
+	for path, value := range values {
+		changes[path] = attributeChange{value, trigger}
+	}
+
+	return changes
+}
+
+// audit records the changes sent to Chef. Attributes that already had the new
+// value on Chef are not recorded.
+func (cu *ChefUpdater) audit(name string, before map[string]interface{},
+	changes map[string]attributeChange) {
+	if cu.Auditor == nil {
+		return
+	}
+
+	now := time.Now()
+	for path, change := range changes {
+		if reflect.DeepEqual(before[path], change.value) {
+			continue
+		}
+
+		cu.Auditor.Audit(AuditEvent{
+			Timestamp: now,
+			Node:      name,
+			Attribute: path,
+			OldValue:  before[path],
+			NewValue:  change.value,
+			Trigger:   change.trigger,
+		})
+	}
+}
@@ -18,11 +18,18 @@
 package updater
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-chef/chef"
 	"github.com/sirupsen/logrus"
@@ -36,15 +43,39 @@ var (
 //Interfaces //
 ///////////////
 
-// ChefAPIClient is an interface for a chef api client
-type ChefAPIClient interface {
-	NewClient(interface{}) interface{}
+// ChefNodesService is an interface for the nodes endpoint of the Chef API.
+// Used for mocking purposes.
+type ChefNodesService interface {
+	List() (map[string]string, error)
+	Get(name string) (chef.Node, error)
+	Put(node chef.Node) (chef.Node, error)
+	Post(node chef.Node) (*chef.NodeResult, error)
 }
 
+// ChefDataBagsService is an interface for the data bags endpoint of the Chef
+// API. Used for mocking purposes.
+type ChefDataBagsService interface {
+	ListItems(databagName string) (*chef.DataBagListResult, error)
+	GetItem(databagName, databagItem string) (chef.DataBagItem, error)
+	CreateItem(databagName string, databagItem chef.DataBagItem) error
+	UpdateItem(databagName, databagItemID string, databagItem chef.DataBagItem) error
+}
+
+// ChefSearchService is an interface for the search endpoint of the Chef API.
+// Each request returns a page of up to rows results, starting at start. Used
+// for mocking purposes.
+type ChefSearchService interface {
+	Exec(idx, statement string, start, rows int) (chef.SearchResult, error)
+	PartialExec(idx, statement string, start, rows int,
+		params map[string]interface{}) (chef.SearchResult, error)
+}
+
+// defaultFetchConcurrency is the number of nodes fetched at the same time when
+// FetchConcurrency is not set.
+const defaultFetchConcurrency = 8
+
 // ChefUpdaterConfig contains the configuration for a ChefUpdater.
 type ChefUpdaterConfig struct {
-	client *chef.Client
-
 	Name                 string
 	URL                  string
 	AccessKey            string
@@ -59,20 +90,139 @@ type ChefUpdaterConfig struct {
 	DataBagName          string
 	DataBagItem          string
 	SkipSSL              bool
+	FetchConcurrency     int
+
+	// SearchQuery is a Chef search query (e.g. "role:sensor") used to get the
+	// nodes instead of listing every node. If PartialSearch is set only the
+	// configured attribute paths are retrieved.
+	SearchQuery   string
+	PartialSearch bool
+
+	// DryRun logs the changes of the nodes instead of sending them to Chef.
+	DryRun bool
+
+	// Defaults are the values of the managed attributes created on the sensor
+	// nodes where they are missing.
+	Defaults AttributeDefaults
+
+	// CheckLicenseExpiry enables blocking the sensors whose license on the
+	// licenses data bag has expired for more than LicenseGracePeriod. These
+	// sensors are flagged at LicenseExpiredPath, so they are unblocked when
+	// the license is renewed even after a restart.
+	CheckLicenseExpiry bool
+	LicenseGracePeriod time.Duration
+	LicenseExpiredPath string
+
+	// OutboxPath is the file where the changes are stored until they are sent
+	// to Chef. No outbox is used if empty.
+	OutboxPath string
+
+	// Auditor records every change sent to Chef. Nothing is recorded if nil.
+	Auditor Auditor
+
+	// ConflictWindow is the time a serial number and the address that sent it
+	// are remembered. Nodes are not updated while their serial number is sent
+	// from several addresses, or their address sends several serial numbers,
+	// during the window. Zero disables the detection.
+	ConflictWindow time.Duration
+
+	// AddressConfirmation is the number of sightings and the time required
+	// before changing the address of a sensor, and the maximum time they can
+	// take. Zero values change it on the first sighting.
+	AddressConfirmation AddressConfirmation
+
+	// Provisioning configures how the serial numbers that don't belong to any
+	// sensor are created on Chef for approval.
+	Provisioning ProvisioningConfig
+
+	// ProductTypes decides which product types are accepted on the flow and
+	// how they match the product types of the nodes.
+	ProductTypes ProductTypePolicy
+
+	// Retry configures the retries of failed requests to the Chef API and the
+	// circuit breaker.
+	Retry RetryConfig
+}
+
+// AttributeDefaults contains the initial values of the attributes managed by
+// the updater. Empty strings mean that the attribute is not created.
+type AttributeDefaults struct {
+	Blocked       bool
+	IPAddress     string
+	ObservationID string
+}
+
+// FetchSummary contains the result of refreshing the nodes database.
+type FetchSummary struct {
+	Fetched  int     // Sensor nodes stored
+	Skipped  int     // Nodes without sensor UUID
+	Failed   int     // Nodes that couldn't be fetched
+	Removed  int     // Sensors no longer on the Chef server
+	Expired  int     // Sensors blocked because their license expired
+	Renewed  int     // Sensors unblocked because their license was renewed
+	Approved int     // Unknown sensors approved on the provisioning data bag
+	Errors   []error // Errors of the failed nodes
+}
+
+// WriteStats contains the number of node updates sent to Chef and the number
+// of updates skipped because the node already had the requested values.
+type WriteStats struct {
+	Writes  uint64
+	Skipped uint64
+}
+
+// LicensesSummary contains the result of applying a set of allowed licenses.
+type LicensesSummary struct {
+	Blocked    int      // Sensors blocked
+	Unblocked  int      // Sensors unblocked
+	Unchanged  int      // Sensors already on the desired state
+	Unlicensed []string // UUIDs of the sensors without a license
 }
 
 // ChefUpdater uses the Chef client API to update a sensor node with an IP
 // address.
 type ChefUpdater struct {
-	nodes map[string]*chef.Node
+	writes        uint64 // Accessed atomically, keep 64-bit aligned
+	skippedWrites uint64 // Accessed atomically, keep 64-bit aligned
+
+	nodes    *sensorsDB
+	client   ChefNodesService
+	writer   ChefNodesService // Used while holding the locks, without retries
+	dataBags ChefDataBagsService
+	search   ChefSearchService
+	retrier  *retrier
+	outbox   *outbox
+	writeMu  sync.Mutex // Serializes the writes of nodes to Chef
+
+	conflicts        *conflictDetector
+	confirmer        *addressConfirmer
+	unknown          unknownSensors
+	unknownConfirmer *addressConfirmer // Sightings of unknown serial numbers
 
 	ChefUpdaterConfig
 }
 
 // NewChefUpdater creates a new instance of a ChefUpdater.
 func NewChefUpdater(config ChefUpdaterConfig) (*ChefUpdater, error) {
+	if err := config.Provisioning.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.AddressConfirmation.validate(); err != nil {
+		return nil, err
+	}
+	if len(config.Provisioning.Mode) > 0 && !config.AddressConfirmation.enabled() {
+		return nil, errors.New("Invalid provisioning: Address confirmation required")
+	}
+	if config.CheckLicenseExpiry && len(config.LicenseExpiredPath) == 0 {
+		return nil, errors.New("Invalid license expiry check: No license expired path")
+	}
+
 	updater := &ChefUpdater{
-		nodes:             make(map[string]*chef.Node),
+		nodes: newSensorsDB(nil,
+			config.SerialNumberPath,
+			config.OrganizationUUIDPath,
+			config.LicenseUUIDPath,
+		),
 		ChefUpdaterConfig: config,
 	}
 
@@ -86,80 +236,498 @@ func NewChefUpdater(config ChefUpdaterConfig) (*ChefUpdater, error) {
 		return nil, errors.New("Error creating client: " + err.Error())
 	}
 
-	updater.client = client
+	if len(config.OutboxPath) > 0 {
+		updater.outbox, err = openOutbox(config.OutboxPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.ConflictWindow > 0 {
+		updater.conflicts = newConflictDetector(config.ConflictWindow)
+	}
+
+	if config.AddressConfirmation.enabled() {
+		updater.confirmer = newAddressConfirmer(config.AddressConfirmation)
+	}
+	if len(config.Provisioning.Mode) > 0 {
+		updater.unknownConfirmer = newAddressConfirmer(config.AddressConfirmation)
+	}
+
+	updater.retrier = newRetrier(config.Retry)
+	updater.client = retryingNodesService{client.Nodes, updater.retrier}
+	updater.writer = retryingNodesService{client.Nodes, updater.retrier.withoutRetries()}
+	updater.dataBags = retryingDataBagsService{client.DataBags, updater.retrier}
+	updater.search = retryingSearchService{searchService{client}, updater.retrier}
 
 	return updater, nil
 }
 
-func (cu *ChefUpdater) fetchLicenses() error {
-	licK := getKeyFromPath(cu.LicenseUUIDPath)
+// fetchLicenses adds the license of every sensor in the data bag to the given
+// nodes. The nodes must not be shared yet. Invalid entries of the data bag are
+// skipped and added to the summary errors.
+func (cu *ChefUpdater) fetchLicenses(nodes map[string]*chef.Node,
+	summary *FetchSummary) (map[string]License, error) {
+	item, err := cu.dataBags.GetItem(cu.DataBagName, cu.DataBagItem)
+	if err != nil {
+		return nil, errors.New("Couldn't get items from data bag: " + err.Error())
+	}
 
-	items, err := cu.client.DataBags.GetItem(cu.DataBagName, cu.DataBagItem)
+	dataBag, errs, err := parseLicensesDataBag(item)
 	if err != nil {
-		return errors.New("Couldn't get items from data bag: " + err.Error())
+		return nil, err
 	}
+	summary.Errors = append(summary.Errors, errs...)
 
-	sensorsIf, ok := items.(map[string]interface{})
-	if !ok {
-		return errors.New("Couldn't get sensors from data bag")
+	if len(cu.LicenseUUIDPath) == 0 {
+		return dataBag.Licenses, nil
 	}
 
-	sensors, ok := sensorsIf["sensors"].(map[string]interface{})
-	if !ok {
-		return errors.New("Couldn't get sensors from data bag. Failed assertion to " +
-			"\"map[string]interface{}\"")
+	for sensor, license := range dataBag.Sensors {
+		if node, ok := nodes[sensor]; ok {
+			setAttribute(node.NormalAttributes, cu.LicenseUUIDPath, license)
+		}
 	}
 
-	for k, v := range sensors {
-		if node, ok := cu.nodes[k]; ok {
-			attributes, err := getParent(node.NormalAttributes, cu.BlockedStatusPath)
-			if err != nil {
-				return errors.New("Error getting node info: " + err.Error())
+	return dataBag.Licenses, nil
+}
+
+// FetchNodes updates the internal node database and keep it in memory. A new
+// set of nodes is built and then replaces the current one.
+//
+// Nodes are obtained using SearchQuery if set, or listing every node on the
+// Chef server otherwise. When listing, up to FetchConcurrency nodes are
+// fetched at the same time and nodes that can't be fetched are reported on the
+// summary and keep their previous state.
+func (cu *ChefUpdater) FetchNodes() (FetchSummary, error) {
+	var (
+		nodes   map[string]*chef.Node
+		summary FetchSummary
+		err     error
+	)
+
+	if len(cu.SearchQuery) > 0 {
+		nodes, summary, err = cu.searchNodes()
+	} else {
+		nodes, summary, err = cu.listNodes()
+	}
+	if err != nil {
+		return summary, err
+	}
+
+	licenses, err := cu.fetchLicenses(nodes, &summary)
+	if err != nil {
+		cu.keepLicenses(nodes)
+	}
+	previous := cu.nodes.swap(nodes)
+	summary.Removed = reportRemovedSensors(previous, nodes)
+
+	// Approved sensors are no longer pending
+	cu.unknown.forget(func(serialNumber string) bool {
+		return findNode(cu.SerialNumberPath, serialNumber, cu.nodes) != nil
+	})
+	cu.unknown.expire(time.Now().Add(-cu.Provisioning.ttl()))
+
+	if cu.Provisioning.Mode == ProvisionDataBag {
+		cu.approveSensors(&summary)
+	}
+	if err != nil {
+		return summary, errors.New("Error fetching licenses: " + err.Error())
+	}
+
+	if cu.CheckLicenseExpiry {
+		cu.checkLicenseExpiry(licenses, time.Now(), &summary)
+	}
+
+	return summary, nil
+}
+
+// keepLicenses copies the license of every sensor on the current snapshot to
+// the given nodes. Used when the licenses can't be fetched, so the sensors are
+// not considered unlicensed until the data bag is available again. The nodes
+// must not be shared yet.
+func (cu *ChefUpdater) keepLicenses(nodes map[string]*chef.Node) {
+	if len(cu.LicenseUUIDPath) == 0 {
+		return
+	}
+
+	for uuid, node := range nodes {
+		current := cu.nodes.get(uuid)
+		if current == nil {
+			continue
+		}
+
+		current.Lock()
+		license, ok := getString(current.NormalAttributes, cu.LicenseUUIDPath)
+		current.Unlock()
+
+		if ok {
+			setAttribute(node.NormalAttributes, cu.LicenseUUIDPath, license)
+		}
+	}
+}
+
+// checkLicenseExpiry blocks the sensors whose license has expired, once the
+// grace period has passed, and unblocks them when the license is renewed.
+// Expired sensors are flagged on the node, also if they were already blocked,
+// so they are kept blocked by other updates until the license is renewed.
+// Sensors whose license is not on the data bag are not changed.
+func (cu *ChefUpdater) checkLicenseExpiry(
+	licenses map[string]License, now time.Time, summary *FetchSummary) {
+	for _, node := range cu.nodes.all() {
+		node.Lock()
+		uuid, _ := getString(node.NormalAttributes, cu.LicenseUUIDPath)
+		license, ok := licenses[uuid]
+		if !ok {
+			node.Unlock()
+			continue
+		}
+
+		expired := license.Expired(now.Add(-cu.LicenseGracePeriod))
+		blocked := cu.blocked(node)
+
+		var err error
+
+		switch {
+		case expired && !cu.licenseExpired(node):
+			_, err = cu.updateAttributes(node, TriggerLicenseExpired,
+				map[string]interface{}{
+					cu.BlockedStatusPath:  true,
+					cu.LicenseExpiredPath: true,
+				})
+			if err == nil {
+				log.Warnf("Blocked sensor %s: License %s expired at %s",
+					node.uuid, uuid, license.Expires.Format(time.RFC3339))
+				summary.Expired++
 			}
 
-			attributes[licK] = v.(map[string]interface{})["license"].(string)
+		case expired && !blocked:
+			_, err = cu.setNodeBlockedLocked(node, true, TriggerLicenseExpired)
+
+		case !expired && cu.licenseExpired(node):
+			_, err = cu.updateAttributes(node, TriggerLicenseRenewed,
+				map[string]interface{}{
+					cu.BlockedStatusPath:  false,
+					cu.LicenseExpiredPath: false,
+				})
+			if err == nil && blocked {
+				log.Infof("Unblocked sensor %s: License %s renewed", node.uuid, uuid)
+				summary.Renewed++
+			}
 		}
+		node.Unlock()
+
+		if err != nil {
+			summary.Errors = append(summary.Errors, err)
+		}
+	}
+}
+
+// blocked checks if a sensor is blocked. The sensor lock must be held by the
+// caller.
+func (cu *ChefUpdater) blocked(node *sensor) bool {
+	attributes, err := getParent(node.NormalAttributes, cu.BlockedStatusPath)
+	return err == nil && attributes[getKeyFromPath(cu.BlockedStatusPath)] == true
+}
+
+// licenseExpired checks if a sensor has been blocked because its license
+// expired. These sensors stay blocked until the license is renewed. The sensor
+// lock must be held by the caller.
+func (cu *ChefUpdater) licenseExpired(node *sensor) bool {
+	if !cu.CheckLicenseExpiry || len(cu.LicenseExpiredPath) == 0 {
+		return false
 	}
 
-	return nil
+	attributes, err := getParent(node.NormalAttributes, cu.LicenseExpiredPath)
+	return err == nil && attributes[getKeyFromPath(cu.LicenseExpiredPath)] == true
 }
 
-// FetchNodes updates the internal node database and keep it in memory
-func (cu *ChefUpdater) FetchNodes() error {
-	nodeList, err := cu.client.Nodes.List()
+// reportRemovedSensors logs the sensors of the previous snapshot that are not
+// on the new set of nodes, either because the node has been deleted or because
+// its sensor UUID has changed. The number of removed sensors is returned.
+func reportRemovedSensors(previous []*sensor, nodes map[string]*chef.Node) int {
+	uuids := make(map[string]string, len(nodes))
+	for uuid, node := range nodes {
+		uuids[node.Name] = uuid
+	}
+
+	removed := 0
+	for _, s := range previous {
+		uuid, ok := uuids[s.name]
+		switch {
+		case !ok:
+			log.Infof("Removed sensor %s: Node %s no longer exists", s.uuid, s.name)
+		case uuid != s.uuid:
+			log.Infof("Removed sensor %s: Node %s has changed its UUID to %s",
+				s.uuid, s.name, uuid)
+		default:
+			continue
+		}
+
+		removed++
+	}
+
+	return removed
+}
+
+func (cu *ChefUpdater) listNodes() (map[string]*chef.Node, FetchSummary, error) {
+	var summary FetchSummary
+
+	nodeList, err := cu.client.List()
 	if err != nil {
-		return errors.New("Couldn't list nodes: " + err.Error())
+		return nil, summary, errors.New("Couldn't list nodes: " + err.Error())
 	}
 
-	for n := range nodeList {
-		node, err := cu.client.Nodes.Get(n)
-		if err != nil {
-			return errors.New("Error getting node info: " + err.Error())
+	workers := cu.FetchConcurrency
+	if workers <= 0 {
+		workers = defaultFetchConcurrency
+	}
+
+	names := make(chan string)
+	results := make(chan fetchResult)
+	wg := new(sync.WaitGroup)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			for name := range names {
+				results <- cu.fetchNode(name)
+			}
+			wg.Done()
+		}()
+	}
+
+	go func() {
+		for name := range nodeList {
+			names <- name
 		}
+		close(names)
+		wg.Wait()
+		close(results)
+	}()
+
+	nodes := make(map[string]*chef.Node)
+	var failed []string
+
+	for result := range results {
+		switch {
+		case result.err != nil:
+			summary.Failed++
+			summary.Errors = append(summary.Errors, result.err)
+			failed = append(failed, result.name)
+
+		case len(result.uuid) == 0:
+			summary.Skipped++
+
+		default:
+			summary.Fetched++
+			nodes[result.uuid] = result.node
+		}
+	}
+
+	cu.keepPreviousNodes(nodes, failed)
+
+	return nodes, summary, nil
+}
+
+// searchNodes gets the nodes matching SearchQuery. With PartialSearch the
+// nodes only contain the configured attribute paths.
+func (cu *ChefUpdater) searchNodes() (map[string]*chef.Node, FetchSummary, error) {
+	var summary FetchSummary
+
+	rows, err := cu.searchRows()
+	if err != nil {
+		return nil, summary, err
+	}
 
-		// Ensure redborder.blocked exists
-		cu.ensureBlockedField(n, &node)
+	nodes := make(map[string]*chef.Node)
 
-		// Get parent of sensor UUID path
-		parentAttrs, err := getParent(node.NormalAttributes, cu.SensorUUIDPath)
+	for _, row := range rows {
+		node, err := cu.searchRowToNode(row)
 		if err != nil {
-			return fmt.Errorf("Failed to get parent attributes for node %s: %v", n, err)
+			summary.Failed++
+			summary.Errors = append(summary.Errors, err)
+			continue
 		}
 
-		sensorKey := getKeyFromPath(cu.SensorUUIDPath)
-		sensorUUID, ok := parentAttrs[sensorKey].(string)
+		sensorUUID, ok := getString(node.NormalAttributes, cu.SensorUUIDPath)
 		if !ok {
+			summary.Skipped++
 			continue
 		}
 
-		cu.nodes[sensorUUID] = &node
+		if err := cu.initAttributes(node); err != nil {
+			log.Errorf("Failed to update node %s: %s", node.Name, err.Error())
+		}
+
+		summary.Fetched++
+		nodes[sensorUUID] = node
 	}
 
-	if err := cu.fetchLicenses(); err != nil {
-		return errors.New("Error fetching licenses: " + err.Error())
+	return nodes, summary, nil
+}
+
+// searchRows returns every row of the results of SearchQuery, requesting them
+// in pages of searchPageSize rows.
+func (cu *ChefUpdater) searchRows() ([]interface{}, error) {
+	var rows []interface{}
+	var keys map[string]interface{}
+	if cu.PartialSearch {
+		keys = cu.partialSearchKeys()
 	}
 
-	return nil
+	for {
+		var result chef.SearchResult
+		var err error
+
+		if cu.PartialSearch {
+			result, err = cu.search.PartialExec("node", cu.SearchQuery,
+				len(rows), searchPageSize, keys)
+		} else {
+			result, err = cu.search.Exec("node", cu.SearchQuery,
+				len(rows), searchPageSize)
+		}
+		if err != nil {
+			return nil, errors.New("Couldn't search nodes: " + err.Error())
+		}
+
+		rows = append(rows, result.Rows...)
+		if len(rows) >= result.Total {
+			return rows, nil
+		}
+		if len(result.Rows) == 0 {
+			return nil, fmt.Errorf("Search returned %d of %d nodes",
+				len(rows), result.Total)
+		}
+	}
+}
+
+// partialSearchKeys returns the partial search parameters for the configured
+// attribute paths. The path itself is used as the key on the results.
+func (cu *ChefUpdater) partialSearchKeys() map[string]interface{} {
+	keys := map[string]interface{}{
+		"name": []string{"name"},
+	}
+
+	for _, path := range []string{
+		cu.SensorUUIDPath,
+		cu.SerialNumberPath,
+		cu.ObservationIDPath,
+		cu.IPAddressPath,
+		cu.BlockedStatusPath,
+		cu.ProductTypePath,
+		cu.OrganizationUUIDPath,
+		cu.LicenseUUIDPath,
+		cu.LicenseExpiredPath,
+	} {
+		if len(path) > 0 {
+			keys[path] = strings.Split(path, "/")
+		}
+	}
+
+	return keys
+}
+
+// searchRowToNode builds a node from a search result row. Partial search rows
+// contain the requested attributes under "data".
+func (cu *ChefUpdater) searchRowToNode(row interface{}) (*chef.Node, error) {
+	if !cu.PartialSearch {
+		raw, err := json.Marshal(row)
+		if err != nil {
+			return nil, errors.New("Invalid search result: " + err.Error())
+		}
+
+		node := new(chef.Node)
+		if err := json.Unmarshal(raw, node); err != nil {
+			return nil, errors.New("Invalid search result: " + err.Error())
+		}
+		if node.NormalAttributes == nil {
+			node.NormalAttributes = make(map[string]interface{})
+		}
+
+		return node, nil
+	}
+
+	fields, ok := row.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Invalid partial search result: %v", row)
+	}
+	data, ok := fields["data"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Invalid partial search result: %v", row)
+	}
+	name, ok := data["name"].(string)
+	if !ok {
+		return nil, fmt.Errorf("Partial search result without name: %v", row)
+	}
+
+	node := &chef.Node{
+		Name:             name,
+		NormalAttributes: make(map[string]interface{}),
+	}
+
+	for path, value := range data {
+		if path == "name" || value == nil {
+			continue
+		}
+
+		setAttribute(node.NormalAttributes, path, value)
+	}
+
+	return node, nil
+}
+
+// fetchResult is the result of fetching a single node. If the node is not a
+// sensor the uuid is empty.
+type fetchResult struct {
+	name string
+	uuid string
+	node *chef.Node
+	err  error
+}
+
+func (cu *ChefUpdater) fetchNode(name string) fetchResult {
+	node, err := cu.client.Get(name)
+	if err != nil {
+		return fetchResult{
+			name: name,
+			err:  fmt.Errorf("Error getting node %s: %s", name, err.Error()),
+		}
+	}
+
+	sensorUUID, ok := getString(node.NormalAttributes, cu.SensorUUIDPath)
+	if !ok {
+		return fetchResult{name: name}
+	}
+
+	if err := cu.initAttributes(&node); err != nil {
+		log.Errorf("Failed to update node %s: %s", name, err.Error())
+	}
+
+	return fetchResult{name: name, uuid: sensorUUID, node: &node}
+}
+
+// keepPreviousNodes adds to nodes a copy of the currently stored sensors for
+// the nodes that couldn't be fetched.
+func (cu *ChefUpdater) keepPreviousNodes(nodes map[string]*chef.Node, failed []string) {
+	if len(failed) == 0 {
+		return
+	}
+
+	names := make(map[string]bool, len(failed))
+	for _, name := range failed {
+		names[name] = true
+	}
+
+	for _, s := range cu.nodes.all() {
+		s.Lock()
+		if names[s.Name] {
+			if node, err := copyNode(s.Node); err == nil {
+				nodes[s.uuid] = node
+			}
+		}
+		s.Unlock()
+	}
 }
 
 // UpdateNode gets a list of nodes an look for one with the given address. If a
@@ -167,39 +735,37 @@ func (cu *ChefUpdater) FetchNodes() error {
 // If a node with the given address is not found an error is returned
 func (cu *ChefUpdater) UpdateNode(
 	address net.IP, serialNumber string, obsID uint32, deviceID uint32) error {
-	pType := getKeyFromPath(cu.ProductTypePath)
+	if !cu.ProductTypes.valid(deviceID) {
+		return fmt.Errorf("Product Type %d for %s is not valid", deviceID, address.String())
+	}
 
-	var (
-		ok                 bool
-		nodeProductType    interface{}
-		nodeProductTypeStr string
-		nodeProductTypeInt uint64
-	)
+	if cu.conflicts != nil {
+		conflicts := cu.conflicts.observe(serialNumber, address.String(), time.Now())
+		if len(conflicts) > 0 {
+			return &ConflictError{conflicts[0]}
+		}
+	}
 
 	node := findNode(cu.SerialNumberPath, serialNumber, cu.nodes)
 	if node == nil {
-		return errors.New("Node not found")
+		return cu.handleUnknownSensor(address.String(), serialNumber, obsID, deviceID)
 	}
 
+	node.Lock()
+	defer node.Unlock()
+
 	attributes, err := getParent(node.NormalAttributes, cu.ProductTypePath)
 	if err != nil {
 		return err
 	}
 
-	if nodeProductType, ok = attributes[pType]; !ok {
-		nodeProductType = "999"
-	}
-
-	if nodeProductTypeStr, ok = nodeProductType.(string); !ok {
-		return errors.New("Product Type is not string")
-	}
-
-	nodeProductTypeInt, err = strconv.ParseUint(nodeProductTypeStr, 10, 32)
+	nodeProductType, err := cu.ProductTypes.nodeProductType(
+		attributes[getKeyFromPath(cu.ProductTypePath)])
 	if err != nil {
 		return err
 	}
 
-	if uint32(nodeProductTypeInt) != deviceID {
+	if !cu.ProductTypes.match(nodeProductType, deviceID) {
 		return errors.New("Product Type for " + address.String() + " does not match")
 	}
 
@@ -208,108 +774,637 @@ func (cu *ChefUpdater) UpdateNode(
 		return err
 	}
 
-	observationIDAttributes, err :=
-		getParent(node.NormalAttributes, cu.ObservationIDPath)
-	if err != nil {
-		return err
+	if cu.confirmer != nil {
+		current, _ := ipaddressAttributes[getKeyFromPath(cu.IPAddressPath)].(string)
+		pending := cu.confirmer.confirm(serialNumber, current, address.String(), time.Now())
+		if pending != nil {
+			return &UnconfirmedAddressError{*pending}
+		}
 	}
 
-	ipaddressAttributes[getKeyFromPath(cu.IPAddressPath)] = address.String()
-	observationIDAttributes[getKeyFromPath(cu.ObservationIDPath)] =
-		strconv.FormatUint(uint64(obsID), 10)
-
-	if cu.client != nil {
-		cu.client.Nodes.Put(*node)
+	// Sensors send several packets per second, so the node is only fetched from
+	// Chef if the cached one has different values. Changes made on Chef in the
+	// meantime are undone after the next sensors database refresh.
+	values := map[string]interface{}{
+		cu.IPAddressPath:     address.String(),
+		cu.ObservationIDPath: strconv.FormatUint(uint64(obsID), 10),
+	}
+	if cached(node, values) {
+		cu.skipWrite(node)
+		return nil
 	}
 
-	return nil
+	_, err = cu.updateAttributes(node, "netflow exporter "+address.String(), values)
+	return err
 }
 
 // BlockOrganization iterates a node list and block all sensor belonging to an
-// organization.
-func (cu *ChefUpdater) BlockOrganization(organization string, productType uint32) []error {
+// organization whose product type matches one of the given product types. The
+// trigger is recorded on the audit trail.
+func (cu *ChefUpdater) BlockOrganization(
+	organization string, productTypes []uint32, trigger string) []error {
+	return cu.setOrganizationBlocked(organization, productTypes, true, trigger)
+}
+
+// UnblockOrganization iterates a node list and unblock all sensor belonging
+// to an organization whose product type matches one of the given product
+// types. The trigger is recorded on the audit trail.
+func (cu *ChefUpdater) UnblockOrganization(
+	organization string, productTypes []uint32, trigger string) []error {
+	return cu.setOrganizationBlocked(organization, productTypes, false, trigger)
+}
+
+func (cu *ChefUpdater) setOrganizationBlocked(organization string,
+	productTypes []uint32, status bool, trigger string) []error {
 	var errs []error
-	blocked := getKeyFromPath(cu.BlockedStatusPath)
-	org := getKeyFromPath(cu.OrganizationUUIDPath)
-	pType := getKeyFromPath(cu.ProductTypePath)
 
-	for _, node := range cu.nodes {
-		log.Infof("Blocking node: %s", node.Name)
+	nodes := cu.nodes.all()
+	if organization != "*" {
+		if found, ok := cu.nodes.find(cu.OrganizationUUIDPath, organization); ok {
+			nodes = found
+		}
+	}
 
-		attributes, err := getParent(node.NormalAttributes, cu.BlockedStatusPath)
-		if err != nil {
-			errs = append(errs, err)
-			continue
+	for _, node := range nodes {
+		if err := cu.setNodeOrganizationBlocked(
+			node, organization, productTypes, status, trigger); err != nil {
+			errs = append(errs, err...)
+		}
+	}
+
+	return errs
+}
+
+func (cu *ChefUpdater) setNodeOrganizationBlocked(node *sensor,
+	organization string, productTypes []uint32, status bool, trigger string) []error {
+	var errs []error
+
+	action := "blocked"
+	if !status {
+		action = "unblocked"
+	}
+
+	node.Lock()
+	defer node.Unlock()
+
+	log.Infof("Checking node: %s", node.Name)
+
+	if _, err := getParent(node.NormalAttributes, cu.BlockedStatusPath); err != nil {
+		return append(errs, err)
+	}
+
+	// The organization and the product type may be under a different parent
+	// than the blocked status.
+	nodeOrganization, _ := getString(node.NormalAttributes, cu.OrganizationUUIDPath)
+	if nodeOrganization == organization || organization == "*" {
+		var productType interface{}
+		if attributes, err := getParent(node.NormalAttributes, cu.ProductTypePath); err == nil {
+			productType = attributes[getKeyFromPath(cu.ProductTypePath)]
 		}
 
-		if attributes[org] == organization || organization == "*" {
-			nodeProductTypeStr, ok := attributes[pType].(string)
-			if !ok {
-				nodeProductTypeStr = "999"
+		nodeProductType, err := cu.ProductTypes.nodeProductType(productType)
+		if err != nil || cu.ProductTypes.matchAny(nodeProductType, productTypes) {
+			if err != nil {
+				errs = append(errs, errors.New("Updating sensor with unknown product type"))
 			}
 
-			nodeProductType, err := strconv.ParseUint(nodeProductTypeStr, 10, 32)
-			if err != nil || uint32(nodeProductType) == productType {
-				if err != nil {
-					errs = append(errs, errors.New("Blocking sensor with unknown product type"))
-				}
-
-				attributes[blocked] = true
-
-				if cu.client != nil {
-					_, err := cu.client.Nodes.Put(*node)
-					if err != nil {
-						errs = append(errs, err)
-					} else {
-						log.Infof("Successfully blocked and updated node %s", node.Name)
-					}
-				}
+			if !status && cu.licenseExpired(node) {
+				log.Infof("Node %s not unblocked: License expired", node.Name)
+				return errs
+			}
+
+			changed, err := cu.updateAttributes(node, trigger,
+				map[string]interface{}{cu.BlockedStatusPath: status})
+			if err != nil {
+				errs = append(errs, err)
+			} else if changed {
+				log.Infof("Successfully %s and updated node %s", action, node.Name)
 			}
 		}
 	}
+
 	return errs
 }
 
-// AllowLicense iterates a node list and unblock all sensors with the given
-// license.
-func (cu *ChefUpdater) AllowLicense(license string) []error {
+// ReconcileLicenses applies a full set of allowed licenses in a single pass.
+// Sensors with one of the licenses are unblocked and the rest are blocked.
+// Only the sensors whose blocked status changes are sent to Chef, so licensed
+// sensors are never blocked in the meantime. The trigger is recorded on the
+// audit trail.
+func (cu *ChefUpdater) ReconcileLicenses(
+	licenses []string, trigger string) (LicensesSummary, []error) {
+	var summary LicensesSummary
 	var errs []error
-	blocked := getKeyFromPath(cu.BlockedStatusPath)
 
-	for _, node := range cu.nodes {
-		attributes, err := getParent(node.NormalAttributes, cu.BlockedStatusPath)
-		if err != nil {
+	allowed := make(map[string]bool, len(licenses))
+	for _, license := range licenses {
+		allowed[license] = true
+	}
+
+	for _, node := range cu.nodes.all() {
+		changed, blocked, err := cu.reconcileNode(node, allowed, trigger)
+		switch {
+		case err != nil:
 			errs = append(errs, err)
-			continue
+		case !changed:
+			summary.Unchanged++
+		case blocked:
+			summary.Blocked++
+		default:
+			summary.Unblocked++
 		}
+	}
+
+	summary.Unlicensed = cu.UnlicensedSensors()
+
+	return summary, errs
+}
 
-		attributes[blocked] = false
+// reconcileNode sets the blocked status of a node depending on its license.
+// Sensors whose license has expired are kept blocked.
+func (cu *ChefUpdater) reconcileNode(node *sensor, allowed map[string]bool,
+	trigger string) (changed, blocked bool, err error) {
+	node.Lock()
+	defer node.Unlock()
 
-		if cu.client != nil {
-			cu.client.Nodes.Put(*node)
+	license, _ := getString(node.NormalAttributes, cu.LicenseUUIDPath)
+	blocked = len(license) == 0 || !allowed[license] || cu.licenseExpired(node)
+
+	changed, err = cu.setNodeBlockedLocked(node, blocked, trigger)
+	return changed, blocked, err
+}
+
+// UnlicensedSensors returns the UUIDs of the sensors without a license
+// assigned. These sensors are always blocked by ReconcileLicenses.
+func (cu *ChefUpdater) UnlicensedSensors() []string {
+	var unlicensed []string
+
+	for _, node := range cu.nodes.all() {
+		node.Lock()
+		license, _ := getString(node.NormalAttributes, cu.LicenseUUIDPath)
+		node.Unlock()
+
+		if len(license) == 0 {
+			unlicensed = append(unlicensed, node.uuid)
 		}
 	}
 
-	return errs
+	sort.Strings(unlicensed)
+	return unlicensed
 }
 
-// ResetAllSensors sets the blocked status to true for all sensors
-func (cu *ChefUpdater) ResetAllSensors() error {
-	blocked := getKeyFromPath(cu.BlockedStatusPath)
+// setNodeBlocked sets the blocked status of a single node and sends the node to
+// Chef.
+func (cu *ChefUpdater) setNodeBlocked(node *sensor, blocked bool, trigger string) error {
+	node.Lock()
+	defer node.Unlock()
 
-	for _, node := range cu.nodes {
-		attributes, err := getParent(node.NormalAttributes, cu.BlockedStatusPath)
+	_, err := cu.setNodeBlockedLocked(node, blocked, trigger)
+	return err
+}
+
+// setNodeBlockedLocked sets the blocked status of a single node and sends the
+// node to Chef if the status has changed. The sensor lock must be held by the
+// caller.
+func (cu *ChefUpdater) setNodeBlockedLocked(
+	node *sensor, blocked bool, trigger string) (bool, error) {
+	return cu.updateAttributes(node, trigger,
+		map[string]interface{}{cu.BlockedStatusPath: blocked})
+}
+
+// Available returns false while the Chef API is considered down and requests
+// are not being sent.
+func (cu *ChefUpdater) Available() bool {
+	return cu.retrier == nil || cu.retrier.breaker.allow() == nil
+}
+
+// WaitAvailable blocks until requests to the Chef API are allowed again.
+func (cu *ChefUpdater) WaitAvailable() {
+	if cu.retrier == nil {
+		return
+	}
+
+	time.Sleep(cu.retrier.breaker.remaining())
+}
+
+// WriteStats returns the number of node updates sent to Chef and skipped
+// since the updater was created.
+func (cu *ChefUpdater) WriteStats() WriteStats {
+	return WriteStats{
+		Writes:  atomic.LoadUint64(&cu.writes),
+		Skipped: atomic.LoadUint64(&cu.skippedWrites),
+	}
+}
+
+// skipWrite records an update that didn't change any attribute of the node.
+func (cu *ChefUpdater) skipWrite(node *sensor) {
+	atomic.AddUint64(&cu.skippedWrites, 1)
+	log.Debugf("Node %s is up to date, skipping update", node.name)
+}
+
+// updateAttributes sets the given attributes on the cached node and sends them
+// to Chef. The cached node may be outdated, so whether an attribute has changed
+// is decided against the node on the Chef server. Returns false if it already
+// had the values. The sensor lock must be held by the caller.
+//
+// The previous cached values are restored if the update is not sent, so
+// retrying the same change sends it again. Changes queued on the outbox are
+// kept, since they are sent later.
+func (cu *ChefUpdater) updateAttributes(node *sensor, trigger string,
+	values map[string]interface{}) (bool, error) {
+	type previousValue struct {
+		value  interface{}
+		exists bool
+	}
+
+	previous := make(map[string]previousValue, len(values))
+	for path := range values {
+		attributes, err := getParent(node.NormalAttributes, path)
 		if err != nil {
-			continue
+			return false, err
+		}
+
+		current, ok := attributes[getKeyFromPath(path)]
+		previous[path] = previousValue{current, ok}
+	}
+
+	for path, value := range values {
+		setAttribute(node.NormalAttributes, path, value)
+	}
+
+	changed, err := cu.putNode(node, trigger, values)
+	if _, queued := err.(*queuedError); err == nil || queued {
+		switch {
+		case !changed:
+			cu.skipWrite(node)
+		case !cu.DryRun:
+			atomic.AddUint64(&cu.writes, 1)
+		}
+
+		return changed, err
+	}
+
+	for path, p := range previous {
+		attributes, _ := getParent(node.NormalAttributes, path)
+		if p.exists {
+			attributes[getKeyFromPath(path)] = p.value
+		} else {
+			delete(attributes, getKeyFromPath(path))
+		}
+	}
+	cu.nodes.reindex(node)
+
+	return true, err
+}
+
+// cached returns true if the cached node already has the given attributes.
+func cached(node *sensor, values map[string]interface{}) bool {
+	for path, value := range values {
+		attributes, err := getParent(node.NormalAttributes, path)
+		if err != nil {
+			return false
 		}
 
-		attributes[blocked] = true
-		if cu.client != nil {
-			cu.client.Nodes.Put(*node)
+		if current, ok := attributes[getKeyFromPath(path)]; !ok || current != value {
+			return false
 		}
 	}
 
-	return nil
+	return true
+}
+
+// queuedError is returned when a change has been stored on the outbox but
+// couldn't be sent to Chef yet.
+type queuedError struct {
+	node string
+	err  error
+}
+
+func (e *queuedError) Error() string {
+	return fmt.Sprintf("Update of node %s queued: %s", e.node, e.err.Error())
+}
+
+// putNode updates the indexes of a modified node and sends the given
+// attributes to Chef. Returns false if the node on Chef already had them. The
+// sensor lock must be held by the caller.
+//
+// If there is an outbox the changes are stored on it before sending them, so
+// they are sent again later if the Chef server is unavailable.
+//
+// Nodes that are no longer on the Chef server are never sent, so they are not
+// created again. The trigger is recorded on the audit trail.
+//
+// On dry run the cached node keeps the values that would have been set.
+func (cu *ChefUpdater) putNode(node *sensor, trigger string,
+	values map[string]interface{}) (bool, error) {
+	if !cu.nodes.exists(node) {
+		return false, fmt.Errorf("Node %s no longer exists", node.name)
+	}
+
+	cu.nodes.reindex(node)
+	if cu.client == nil {
+		return true, nil
+	}
+
+	var full chef.Node
+	var changed bool
+	var err error
+
+	if cu.outbox == nil || cu.DryRun {
+		cu.writeMu.Lock()
+		full, changed, err = cu.writeNode(node.Name, newChanges(values, trigger))
+		cu.writeMu.Unlock()
+	} else {
+		if err := cu.outbox.add(node.Name, trigger, values); err != nil {
+			return false, err
+		}
+
+		full, changed, err = cu.deliverPending(node.Name)
+		if isUnavailable(err) {
+			return true, &queuedError{node.Name, err}
+		}
+	}
+	if err != nil {
+		return false, cu.checkNotFound(node, err)
+	}
+
+	// Nodes obtained with partial search only have some attributes, so they
+	// are kept as they are. The license comes from the data bag and not from the
+	// node, so it's kept too. On dry run the node on Chef doesn't have the
+	// simulated values.
+	if (len(cu.SearchQuery) == 0 || !cu.PartialSearch) && !cu.DryRun {
+		license, licensed := getString(node.NormalAttributes, cu.LicenseUUIDPath)
+		*node.Node = full
+		if licensed {
+			setAttribute(node.NormalAttributes, cu.LicenseUUIDPath, license)
+		}
+
+		cu.nodes.reindex(node)
+	}
+
+	return changed, nil
+}
+
+// deliverPending sends the pending changes of a node on the outbox to Chef.
+// The changes are removed from the outbox unless the Chef server is
+// unavailable. Returns false if the node on Chef already had them.
+func (cu *ChefUpdater) deliverPending(name string) (chef.Node, bool, error) {
+	cu.writeMu.Lock()
+	defer cu.writeMu.Unlock()
+
+	entries := cu.outbox.pending(name)
+	if len(entries) == 0 {
+		full, err := cu.nodeWriter().Get(name)
+		return full, false, err
+	}
+
+	changes := make(map[string]attributeChange, len(entries))
+	for _, entry := range entries {
+		changes[entry.Path] = attributeChange{entry.Value, entry.Trigger}
+	}
+
+	full, changed, err := cu.writeNode(name, changes)
+	if isUnavailable(err) {
+		return full, changed, err
+	}
+
+	if err := cu.outbox.done(entries); err != nil {
+		log.Errorf("Error updating outbox: %s", err.Error())
+	}
+
+	return full, changed, err
+}
+
+// writeNode sets the attributes at the given paths on a node and sends it to
+// Chef. Returns false, without sending the node, if it already had the values.
+// The writeMu lock must be held by the caller. On dry run the changes are only
+// logged.
+//
+// The cached node may be outdated, so the current node is fetched from the
+// Chef server, and the attributes are compared and changed on it before
+// sending it back. This way attributes modified by chef-client or by an
+// operator are not reverted. The Chef server doesn't detect concurrent updates
+// of a node, so there are no conflicts to retry: fetching it right before the
+// update only narrows the window in which other changes can be overwritten.
+//
+// Every change is recorded on the audit trail.
+func (cu *ChefUpdater) writeNode(name string,
+	changes map[string]attributeChange) (chef.Node, bool, error) {
+	full, err := cu.nodeWriter().Get(name)
+	if err != nil {
+		return full, false, err
+	}
+	if full.NormalAttributes == nil {
+		full.NormalAttributes = make(map[string]interface{})
+	}
+
+	before := make(map[string]interface{}, len(changes))
+	changed := make(map[string]attributeChange, len(changes))
+	for path, change := range changes {
+		if parent, err := getParent(full.NormalAttributes, path); err == nil {
+			current, ok := parent[getKeyFromPath(path)]
+			if ok && reflect.DeepEqual(current, change.value) {
+				continue
+			}
+
+			before[path] = current
+		}
+
+		changed[path] = change
+		setAttribute(full.NormalAttributes, path, change.value)
+	}
+
+	if len(changed) == 0 {
+		return full, false, nil
+	}
+
+	if cu.DryRun {
+		logDiff(name, before, changed)
+		return full, true, nil
+	}
+
+	if _, err = cu.nodeWriter().Put(full); err != nil {
+		return full, true, err
+	}
+
+	cu.audit(name, before, changed)
+	return full, true, nil
+}
+
+// nodeWriter returns the client used to update nodes. Node updates are sent
+// while holding the sensor and write locks, so they are not retried: waiting
+// for a retry would block every other update. Failed updates are sent again
+// from the outbox instead.
+func (cu *ChefUpdater) nodeWriter() ChefNodesService {
+	if cu.writer == nil {
+		return cu.client
+	}
+
+	return cu.writer
+}
+
+// logDiff logs the value of each changed attribute before and after a dry run
+// update.
+func logDiff(name string, before map[string]interface{},
+	changes map[string]attributeChange) {
+	paths := make([]string, 0, len(changes))
+	for path := range changes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		log.WithFields(logrus.Fields{
+			"node":      name,
+			"attribute": path,
+			"before":    before[path],
+			"after":     changes[path].value,
+			"trigger":   changes[path].trigger,
+		}).Info("Dry run: node not updated")
+	}
+}
+
+// ReplayOutbox sends the changes on the outbox to Chef in the order they were
+// made. Replaying stops when the Chef server is unavailable. Returns the
+// number of nodes updated.
+func (cu *ChefUpdater) ReplayOutbox() (int, error) {
+	if cu.outbox == nil || cu.client == nil || cu.DryRun {
+		return 0, nil
+	}
+
+	replayed := 0
+	for _, name := range cu.outbox.nodes() {
+		_, _, err := cu.deliverPending(name)
+		if isUnavailable(err) {
+			return replayed, err
+		}
+		if err != nil {
+			log.Warnf("Discarded pending update of node %s: %s", name, err.Error())
+			continue
+		}
+
+		replayed++
+	}
+
+	return replayed, nil
+}
+
+// OutboxDepth returns the number of attribute changes waiting to be sent to
+// Chef.
+func (cu *ChefUpdater) OutboxDepth() int {
+	if cu.outbox == nil {
+		return 0
+	}
+
+	return cu.outbox.len()
+}
+
+// Conflicts returns the active conflicts between sensors.
+func (cu *ChefUpdater) Conflicts() []Conflict {
+	if cu.conflicts == nil {
+		return nil
+	}
+
+	return cu.conflicts.conflicts()
+}
+
+// ConflictEvents returns a channel that receives an event when a conflict
+// between sensors is detected and when it's resolved. Nil if the detection is
+// disabled.
+func (cu *ChefUpdater) ConflictEvents() <-chan ConflictEvent {
+	if cu.conflicts == nil {
+		return nil
+	}
+
+	return cu.conflicts.events
+}
+
+// PendingAddresses returns the new addresses of the sensors waiting to be
+// confirmed, sorted by serial number.
+func (cu *ChefUpdater) PendingAddresses() []PendingAddress {
+	if cu.confirmer == nil {
+		return nil
+	}
+
+	return cu.confirmer.list()
+}
+
+// UnknownSensors returns the serial numbers seen on the flow that don't belong
+// to any sensor, sorted by serial number.
+func (cu *ChefUpdater) UnknownSensors() []UnknownSensor {
+	return cu.unknown.list()
+}
+
+// Close closes the outbox. Pending changes are sent when the updater is
+// created again.
+func (cu *ChefUpdater) Close() error {
+	if cu.outbox == nil {
+		return nil
+	}
+
+	return cu.outbox.close()
+}
+
+// checkNotFound removes a sensor from the database if the Chef server reports
+// that its node doesn't exist. The error is returned unchanged.
+func (cu *ChefUpdater) checkNotFound(node *sensor, err error) error {
+	if isNotFound(err) {
+		log.Infof("Removed sensor %s: Node %s no longer exists", node.uuid, node.name)
+		cu.nodes.remove(node)
+	}
+
+	return err
+}
+
+// isUnavailable checks if an error means that the Chef server couldn't be
+// reached, so the request should be sent again later.
+func isUnavailable(err error) bool {
+	return err == ErrCircuitOpen || isRetryable(err)
+}
+
+// isConflict checks if an error is a "409 Conflict" response from the Chef
+// server.
+func isConflict(err error) bool {
+	chefErr, ok := err.(*chef.ErrorResponse)
+	return ok && chefErr.Response != nil &&
+		chefErr.Response.StatusCode == http.StatusConflict
+}
+
+// isNotFound checks if an error is a "404 Not Found" response from the Chef
+// server.
+func isNotFound(err error) bool {
+	chefErr, ok := err.(*chef.ErrorResponse)
+	return ok && chefErr.Response != nil &&
+		chefErr.Response.StatusCode == http.StatusNotFound
+}
+
+// BlockSensor sets the blocked status to true for a single sensor, identified
+// by its UUID or, if empty, by its serial number. The trigger is recorded on
+// the audit trail.
+func (cu *ChefUpdater) BlockSensor(uuid, serialNumber, trigger string) error {
+	return cu.setSensorBlocked(uuid, serialNumber, true, trigger)
+}
+
+// UnblockSensor sets the blocked status to false for a single sensor,
+// identified by its UUID or, if empty, by its serial number. The trigger is
+// recorded on the audit trail.
+func (cu *ChefUpdater) UnblockSensor(uuid, serialNumber, trigger string) error {
+	return cu.setSensorBlocked(uuid, serialNumber, false, trigger)
+}
+
+func (cu *ChefUpdater) setSensorBlocked(
+	uuid, serialNumber string, blocked bool, trigger string) error {
+	var node *sensor
+	if len(uuid) > 0 {
+		node = cu.nodes.get(uuid)
+	} else if len(serialNumber) > 0 {
+		node = findNode(cu.SerialNumberPath, serialNumber, cu.nodes)
+	}
+	if node == nil {
+		return errors.New("Node not found")
+	}
+
+	return cu.setNodeBlocked(node, blocked, trigger)
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -341,22 +1436,75 @@ func getParent(root map[string]interface{}, path string) (map[string]interface{}
 	return current, nil
 }
 
-func findNode(keyPath string, value string, nodes map[string]*chef.Node,
-) (node *chef.Node) {
+// setAttribute sets the value of the attribute on the given path, creating the
+// intermediate objects if needed. Intermediate values that are not objects are
+// replaced.
+func setAttribute(root map[string]interface{}, path string, value interface{}) {
+	keys := strings.Split(path, "/")
+	current := root
+
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := current[key].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			current[key] = next
+		}
+
+		current = next
+	}
+
+	current[keys[len(keys)-1]] = value
+}
+
+// findNode returns the sensor whose attribute at keyPath has the given value
+// or nil if there is no such sensor. The index for keyPath is used if there is
+// one.
+func findNode(keyPath string, value string, nodes *sensorsDB) *sensor {
+	found := findNodes(keyPath, value, nodes)
+	if len(found) == 0 {
+		return nil
+	}
+
+	return found[0]
+}
+
+// findNodes returns the sensors whose attribute at keyPath has the given
+// value. The index for keyPath is used if there is one.
+func findNodes(keyPath string, value string, nodes *sensorsDB) []*sensor {
+	if found, ok := nodes.find(keyPath, value); ok {
+		return found
+	}
+
+	var found []*sensor
 	key := getKeyFromPath(keyPath)
 
-	for _, node := range nodes {
+	for _, node := range nodes.all() {
+		node.Lock()
 		attributes, err := getParent(node.NormalAttributes, keyPath)
-		if err != nil {
-			continue
-		}
+		matches := err == nil && attributes[key] == value
+		node.Unlock()
 
-		if attributes[key] == value {
-			return node
+		if matches {
+			found = append(found, node)
 		}
 	}
 
-	return nil
+	return found
+}
+
+// copyNode returns a deep copy of a node.
+func copyNode(node *chef.Node) (*chef.Node, error) {
+	raw, err := json.Marshal(node)
+	if err != nil {
+		return nil, err
+	}
+
+	copied := new(chef.Node)
+	if err := json.Unmarshal(raw, copied); err != nil {
+		return nil, err
+	}
+
+	return copied, nil
 }
 
 func getKeyFromPath(path string) string {
@@ -364,20 +1512,51 @@ func getKeyFromPath(path string) string {
 	return keys[len(keys)-1]
 }
 
-// Create blocked (redborder -> blocked) field if it doesn't exist in the passed node as parameter
-func (cu *ChefUpdater) ensureBlockedField(n string, node *chef.Node) {
-	redborderAttrs, ok := node.NormalAttributes["redborder"].(map[string]interface{})
-	if !ok || redborderAttrs == nil {
-		redborderAttrs = make(map[string]interface{})
-		node.NormalAttributes["redborder"] = redborderAttrs
+// initAttributes creates the managed attributes missing on a sensor node with
+// their default values and sends them to Chef. The IP address and the
+// Observation ID are only created if they have a default value.
+func (cu *ChefUpdater) initAttributes(node *chef.Node) error {
+	if node.NormalAttributes == nil {
+		node.NormalAttributes = make(map[string]interface{})
+	}
+
+	defaults := []struct {
+		path  string
+		value interface{}
+	}{
+		{cu.BlockedStatusPath, cu.Defaults.Blocked},
+		{cu.IPAddressPath, cu.Defaults.IPAddress},
+		{cu.ObservationIDPath, cu.Defaults.ObservationID},
 	}
 
-	if _, exists := redborderAttrs["blocked"]; !exists {
-		log.Infof("Adding missing 'blocked: false' field to node %s", n)
-		redborderAttrs["blocked"] = false
+	changes := make(map[string]interface{})
+	var created []string
 
-		if _, err := cu.client.Nodes.Put(*node); err != nil {
-			log.Errorf("Failed to update node %s: %v", n, err)
+	for _, d := range defaults {
+		if len(d.path) == 0 || d.value == "" {
+			continue
+		}
+
+		attributes, err := getParent(node.NormalAttributes, d.path)
+		if err == nil && attributes[getKeyFromPath(d.path)] != nil {
+			continue
 		}
+
+		setAttribute(node.NormalAttributes, d.path, d.value)
+		changes[d.path] = d.value
+		created = append(created, fmt.Sprintf("%s: %v", d.path, d.value))
+	}
+
+	if len(changes) == 0 || cu.client == nil {
+		return nil
 	}
+
+	log.Infof("Adding missing attributes to node %s [%s]",
+		node.Name, strings.Join(created, " | "))
+
+	cu.writeMu.Lock()
+	defer cu.writeMu.Unlock()
+
+	_, _, err := cu.writeNode(node.Name, newChanges(changes, TriggerDefaultValue))
+	return err
 }
@@ -0,0 +1,178 @@
+// Service for allowing new sensors to send flow based on a serial number.
+// Copyright (C) 2017 ENEO Tecnologia SL
+// Author: Diego Fernández Barrear <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package updater
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultConfirmationWindow is the minimum time a new address is pending when
+// AddressConfirmation.Window is not set.
+const defaultConfirmationWindow = time.Hour
+
+// AddressConfirmation is the policy for accepting a new address of a sensor.
+// The address on the node is only changed after the given number of sightings
+// from the new address, spanning at least the given period and at most the
+// given window. A sighting from the current address, or from another new
+// address, starts over, and so does a sighting after the window.
+type AddressConfirmation struct {
+	Sightings int           // Sightings from the new address
+	Period    time.Duration // Time between the first and the last sighting
+	Window    time.Duration // Maximum time between the first and the last sighting
+}
+
+func (c AddressConfirmation) enabled() bool {
+	return c.Sightings > 1 || c.Period > 0
+}
+
+func (c AddressConfirmation) validate() error {
+	if c.Window > 0 && c.Window < c.Period {
+		return errors.New("Invalid address confirmation: Window shorter than period")
+	}
+
+	return nil
+}
+
+// window returns the time a new address is pending. If Window is not set it's
+// twice the period, and at least defaultConfirmationWindow.
+func (c AddressConfirmation) window() time.Duration {
+	if c.Window > 0 {
+		return c.Window
+	}
+	if 2*c.Period > defaultConfirmationWindow {
+		return 2 * c.Period
+	}
+
+	return defaultConfirmationWindow
+}
+
+// PendingAddress is a new address of a sensor waiting to be confirmed.
+type PendingAddress struct {
+	SerialNumber string
+	Current      string // Address on the node
+	Address      string // New address
+	FirstSeen    time.Time
+	LastSeen     time.Time
+	Sightings    int
+}
+
+// UnconfirmedAddressError is returned when a node is not updated because the
+// new address is not confirmed yet.
+type UnconfirmedAddressError struct {
+	PendingAddress
+}
+
+func (e *UnconfirmedAddressError) Error() string {
+	return fmt.Sprintf("Address %s of sensor %s not confirmed: %d sightings in %s",
+		e.Address, e.SerialNumber, e.Sightings, e.LastSeen.Sub(e.FirstSeen))
+}
+
+// addressConfirmer keeps the new addresses of the sensors until they are
+// confirmed.
+type addressConfirmer struct {
+	mu      sync.Mutex
+	policy  AddressConfirmation
+	pending map[string]*PendingAddress // By serial number
+	pruned  time.Time
+}
+
+func newAddressConfirmer(policy AddressConfirmation) *addressConfirmer {
+	return &addressConfirmer{
+		policy:  policy,
+		pending: make(map[string]*PendingAddress),
+	}
+}
+
+// confirm records a sighting of a sensor. Returns nil if the address can be
+// set on the node, or the pending change otherwise.
+func (c *addressConfirmer) confirm(serialNumber, current, address string,
+	now time.Time) *PendingAddress {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	window := c.policy.window()
+	if now.Sub(c.pruned) >= window {
+		c.prune(now)
+	}
+
+	if address == current {
+		delete(c.pending, serialNumber)
+		return nil
+	}
+
+	pending, ok := c.pending[serialNumber]
+	if !ok || pending.Address != address || pending.Current != current ||
+		now.Sub(pending.FirstSeen) > window {
+		pending = &PendingAddress{
+			SerialNumber: serialNumber,
+			Current:      current,
+			Address:      address,
+			FirstSeen:    now,
+		}
+		c.pending[serialNumber] = pending
+	}
+
+	pending.Sightings++
+	pending.LastSeen = now
+
+	if pending.Sightings >= c.policy.Sightings &&
+		pending.LastSeen.Sub(pending.FirstSeen) >= c.policy.Period {
+		delete(c.pending, serialNumber)
+		return nil
+	}
+
+	p := *pending
+	return &p
+}
+
+// prune discards the pending changes first seen more than a window ago. The
+// lock must be held by the caller.
+func (c *addressConfirmer) prune(now time.Time) {
+	window := c.policy.window()
+
+	for serialNumber, pending := range c.pending {
+		if now.Sub(pending.FirstSeen) > window {
+			delete(c.pending, serialNumber)
+		}
+	}
+
+	c.pruned = now
+}
+
+// list returns the pending changes sorted by serial number.
+func (c *addressConfirmer) list() []PendingAddress {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	serialNumbers := make([]string, 0, len(c.pending))
+	for serialNumber := range c.pending {
+		serialNumbers = append(serialNumbers, serialNumber)
+	}
+	sort.Strings(serialNumbers)
+
+	pending := make([]PendingAddress, 0, len(serialNumbers))
+	for _, serialNumber := range serialNumbers {
+		pending = append(pending, *c.pending[serialNumber])
+	}
+
+	return pending
+}
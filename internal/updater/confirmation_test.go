@@ -0,0 +1,155 @@
+// Service for allowing new sensors to send flow based on a serial number.
+// Copyright (C) 2017 ENEO Tecnologia SL
+// Author: Diego Fernández Barrear <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package updater
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-chef/chef"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestAddressConfirmation(t *testing.T) {
+	c := newAddressConfirmer(AddressConfirmation{
+		Sightings: 3,
+		Period:    time.Minute,
+	})
+	now := time.Date(2017, 6, 1, 10, 0, 0, 0, time.UTC)
+
+	assert.Nil(t, c.confirm("111111", "10.0.0.1", "10.0.0.1", now))
+
+	pending := c.confirm("111111", "10.0.0.1", "10.0.0.2", now)
+	if assert.NotNil(t, pending) {
+		assert.Equal(t, "10.0.0.1", pending.Current)
+		assert.Equal(t, "10.0.0.2", pending.Address)
+		assert.Equal(t, 1, pending.Sightings)
+	}
+
+	// Enough sightings but not enough time
+	assert.NotNil(t, c.confirm("111111", "10.0.0.1", "10.0.0.2", now.Add(10*time.Second)))
+	pending = c.confirm("111111", "10.0.0.1", "10.0.0.2", now.Add(20*time.Second))
+	if assert.NotNil(t, pending) {
+		assert.Equal(t, 3, pending.Sightings)
+		assert.Equal(t, now, pending.FirstSeen)
+	}
+
+	assert.Equal(t, []PendingAddress{*pending}, c.list())
+
+	assert.Nil(t, c.confirm("111111", "10.0.0.1", "10.0.0.2", now.Add(time.Minute)))
+	assert.Empty(t, c.list())
+}
+
+func TestAddressConfirmationReset(t *testing.T) {
+	c := newAddressConfirmer(AddressConfirmation{Sightings: 2})
+	now := time.Date(2017, 6, 1, 10, 0, 0, 0, time.UTC)
+
+	assert.NotNil(t, c.confirm("111111", "10.0.0.1", "10.0.0.2", now))
+
+	// Another new address starts over
+	pending := c.confirm("111111", "10.0.0.1", "10.0.0.3", now)
+	if assert.NotNil(t, pending) {
+		assert.Equal(t, "10.0.0.3", pending.Address)
+		assert.Equal(t, 1, pending.Sightings)
+	}
+
+	// So does a sighting from the current address
+	assert.Nil(t, c.confirm("111111", "10.0.0.1", "10.0.0.1", now))
+	assert.Empty(t, c.list())
+
+	assert.NotNil(t, c.confirm("111111", "10.0.0.1", "10.0.0.3", now))
+	assert.Nil(t, c.confirm("111111", "10.0.0.1", "10.0.0.3", now))
+}
+
+func TestUpdateNodeAddressConfirmation(t *testing.T) {
+	nodesAPI := new(ChefNodesMock)
+	nodesAPI.On("Get", "sensor-a").Return(sensorNode("sensor-a", "aaaa", "111111"), nil)
+	nodesAPI.On("Put", mock.AnythingOfType("chef.Node")).Return(chef.Node{}, nil)
+
+	node := sensorNode("sensor-a", "aaaa", "111111")
+	chefUpdater := &ChefUpdater{
+		nodes:     newSensorsDB(map[string]*chef.Node{"aaaa": &node}),
+		client:    nodesAPI,
+		confirmer: newAddressConfirmer(AddressConfirmation{Sightings: 2}),
+		ChefUpdaterConfig: ChefUpdaterConfig{
+			SensorUUIDPath:    "org/uuid",
+			SerialNumberPath:  "org/serial_number",
+			BlockedStatusPath: "org/blocked",
+			IPAddressPath:     "org/ipaddress",
+			ObservationIDPath: "org/observation_id",
+		},
+	}
+
+	err := chefUpdater.UpdateNode(net.ParseIP("10.0.0.1"), "111111", 10, 999)
+	assert.IsType(t, &UnconfirmedAddressError{}, err)
+	nodesAPI.AssertNotCalled(t, "Put", mock.Anything)
+
+	if assert.Len(t, chefUpdater.PendingAddresses(), 1) {
+		assert.Equal(t, "10.0.0.1", chefUpdater.PendingAddresses()[0].Address)
+	}
+
+	assert.NoError(t, chefUpdater.UpdateNode(net.ParseIP("10.0.0.1"), "111111", 10, 999))
+	assert.Empty(t, chefUpdater.PendingAddresses())
+
+	attrs, err := getParent(chefUpdater.nodes.get("aaaa").NormalAttributes, "org/ipaddress")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", attrs["ipaddress"])
+}
+
+func TestAddressConfirmationWindow(t *testing.T) {
+	c := newAddressConfirmer(AddressConfirmation{
+		Sightings: 3,
+		Period:    time.Minute,
+		Window:    10 * time.Minute,
+	})
+	now := time.Date(2017, 6, 1, 10, 0, 0, 0, time.UTC)
+
+	assert.NotNil(t, c.confirm("111111", "10.0.0.1", "10.0.0.2", now))
+	assert.NotNil(t, c.confirm("111111", "10.0.0.1", "10.0.0.2", now.Add(5*time.Minute)))
+
+	// Sightings after the window start over
+	pending := c.confirm("111111", "10.0.0.1", "10.0.0.2", now.Add(11*time.Minute))
+	if assert.NotNil(t, pending) {
+		assert.Equal(t, 1, pending.Sightings)
+		assert.Equal(t, now.Add(11*time.Minute), pending.FirstSeen)
+	}
+
+	// Pending changes are discarded after the window
+	assert.NotNil(t, c.confirm("222222", "10.0.0.3", "10.0.0.4", now.Add(12*time.Minute)))
+	assert.Len(t, c.list(), 2)
+
+	assert.Nil(t, c.confirm("333333", "10.0.0.5", "10.0.0.5", now.Add(22*time.Minute)))
+	if assert.Len(t, c.list(), 1) {
+		assert.Equal(t, "222222", c.list()[0].SerialNumber)
+	}
+
+	assert.Nil(t, c.confirm("444444", "10.0.0.6", "10.0.0.6", now.Add(23*time.Minute)))
+	assert.Nil(t, c.confirm("444444", "10.0.0.6", "10.0.0.6", now.Add(33*time.Minute)))
+	assert.Empty(t, c.list())
+}
+
+func TestAddressConfirmationDefaultWindow(t *testing.T) {
+	assert.Equal(t, defaultConfirmationWindow, AddressConfirmation{Sightings: 2}.window())
+	assert.Equal(t, 4*time.Hour, AddressConfirmation{Period: 2 * time.Hour}.window())
+	assert.Equal(t, time.Minute, AddressConfirmation{Window: time.Minute}.window())
+
+	assert.Error(t, AddressConfirmation{Period: time.Hour, Window: time.Minute}.validate())
+	assert.NoError(t, AddressConfirmation{Period: time.Minute}.validate())
+}
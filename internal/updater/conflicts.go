@@ -0,0 +1,247 @@
+// Service for allowing new sensors to send flow based on a serial number.
+// Copyright (C) 2017 ENEO Tecnologia SL
+// Author: Diego Fernández Barrear <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package updater
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// conflictEventsBuffer is the number of conflict events kept until they are
+// read. Newer events are dropped when the buffer is full.
+const conflictEventsBuffer = 100
+
+// ConflictKind is the type of a conflict between sensors.
+type ConflictKind string
+
+const (
+	// SerialNumberConflict is a serial number sent from several addresses,
+	// e.g. a cloned or spoofed device.
+	SerialNumberConflict ConflictKind = "serial_number"
+
+	// AddressConflict is an address sending several serial numbers.
+	AddressConflict ConflictKind = "address"
+)
+
+// Conflict is a serial number or an address seen with more than one address
+// or serial number during the conflict window.
+type Conflict struct {
+	Kind   ConflictKind
+	Key    string    // Serial number or address in conflict
+	Values []string  // Addresses or serial numbers seen, sorted
+	Since  time.Time // Time the conflict was detected
+}
+
+func (c Conflict) String() string {
+	if c.Kind == SerialNumberConflict {
+		return fmt.Sprintf("serial number %s sent from %s",
+			c.Key, strings.Join(c.Values, ", "))
+	}
+
+	return fmt.Sprintf("address %s sending serial numbers %s",
+		c.Key, strings.Join(c.Values, ", "))
+}
+
+// ConflictEvent is sent when a conflict is detected and when it's resolved.
+type ConflictEvent struct {
+	Conflict
+	Resolved bool
+}
+
+// ConflictError is returned when a node is not updated because of a conflict.
+type ConflictError struct {
+	Conflict
+}
+
+func (e *ConflictError) Error() string {
+	return "Conflict: " + e.Conflict.String()
+}
+
+type conflictKey struct {
+	kind ConflictKind
+	key  string
+}
+
+// conflictDetector keeps the addresses of each serial number and the serial
+// numbers of each address seen during a time window. Sightings older than the
+// window are forgotten, so a conflict lasts until one of the parts stops
+// sending flow for a whole window.
+type conflictDetector struct {
+	mu        sync.Mutex
+	window    time.Duration
+	serials   map[string]map[string]time.Time // Last sighting of each address
+	addresses map[string]map[string]time.Time // Last sighting of each serial
+	active    map[conflictKey]*Conflict
+	lastSweep time.Time
+	events    chan ConflictEvent
+}
+
+func newConflictDetector(window time.Duration) *conflictDetector {
+	return &conflictDetector{
+		window:    window,
+		serials:   make(map[string]map[string]time.Time),
+		addresses: make(map[string]map[string]time.Time),
+		active:    make(map[conflictKey]*Conflict),
+		events:    make(chan ConflictEvent, conflictEventsBuffer),
+	}
+}
+
+// observe records a serial number sent from an address and returns the
+// conflicts of both.
+func (d *conflictDetector) observe(serialNumber, address string,
+	now time.Time) []Conflict {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if now.Sub(d.lastSweep) >= d.window {
+		d.sweep(now)
+	}
+
+	record(d.serials, serialNumber, address, now)
+	record(d.addresses, address, serialNumber, now)
+
+	var conflicts []Conflict
+	if c := d.check(SerialNumberConflict, serialNumber, d.serials, now); c != nil {
+		conflicts = append(conflicts, *c)
+	}
+	if c := d.check(AddressConflict, address, d.addresses, now); c != nil {
+		conflicts = append(conflicts, *c)
+	}
+
+	return conflicts
+}
+
+// check updates the state of the conflict of a serial number or address.
+// Returns the conflict if there is one.
+func (d *conflictDetector) check(kind ConflictKind, key string,
+	seen map[string]map[string]time.Time, now time.Time) *Conflict {
+	values := d.prune(seen, key, now)
+
+	k := conflictKey{kind, key}
+	conflict, ok := d.active[k]
+
+	if len(values) < 2 {
+		if ok {
+			delete(d.active, k)
+			d.emit(ConflictEvent{*conflict, true})
+		}
+		return nil
+	}
+
+	if !ok {
+		conflict = &Conflict{Kind: kind, Key: key, Since: now}
+		d.active[k] = conflict
+	}
+	conflict.Values = values
+
+	if !ok {
+		d.emit(ConflictEvent{*conflict, false})
+	}
+
+	c := *conflict
+	return &c
+}
+
+// prune forgets the sightings of a key older than the window. Returns the
+// remaining values, sorted.
+func (d *conflictDetector) prune(seen map[string]map[string]time.Time,
+	key string, now time.Time) []string {
+	var values []string
+	for value, last := range seen[key] {
+		if now.Sub(last) > d.window {
+			delete(seen[key], value)
+			continue
+		}
+		values = append(values, value)
+	}
+
+	if len(seen[key]) == 0 {
+		delete(seen, key)
+	}
+
+	sort.Strings(values)
+	return values
+}
+
+// sweep forgets every sighting older than the window and resolves the
+// conflicts whose parts are no longer seen.
+func (d *conflictDetector) sweep(now time.Time) {
+	d.lastSweep = now
+
+	for serialNumber := range d.serials {
+		d.prune(d.serials, serialNumber, now)
+	}
+	for address := range d.addresses {
+		d.prune(d.addresses, address, now)
+	}
+
+	for k := range d.active {
+		if k.kind == SerialNumberConflict {
+			d.check(k.kind, k.key, d.serials, now)
+		} else {
+			d.check(k.kind, k.key, d.addresses, now)
+		}
+	}
+}
+
+// conflicts returns the active conflicts.
+func (d *conflictDetector) conflicts() []Conflict {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	conflicts := make([]Conflict, 0, len(d.active))
+	for _, conflict := range d.active {
+		conflicts = append(conflicts, *conflict)
+	}
+
+	sort.Sort(byConflictKey(conflicts))
+	return conflicts
+}
+
+// emit sends an event without blocking. Events are dropped if nobody is
+// reading them.
+func (d *conflictDetector) emit(event ConflictEvent) {
+	select {
+	case d.events <- event:
+	default:
+		log.Warnf("Conflict event dropped: %s", event.Conflict.String())
+	}
+}
+
+func record(seen map[string]map[string]time.Time, key, value string,
+	now time.Time) {
+	if seen[key] == nil {
+		seen[key] = make(map[string]time.Time)
+	}
+
+	seen[key][value] = now
+}
+
+type byConflictKey []Conflict
+
+func (s byConflictKey) Len() int      { return len(s) }
+func (s byConflictKey) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byConflictKey) Less(i, j int) bool {
+	if s[i].Kind != s[j].Kind {
+		return s[i].Kind < s[j].Kind
+	}
+	return s[i].Key < s[j].Key
+}
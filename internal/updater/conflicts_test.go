@@ -0,0 +1,129 @@
+// Service for allowing new sensors to send flow based on a serial number.
+// Copyright (C) 2017 ENEO Tecnologia SL
+// Author: Diego Fernández Barrear <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package updater
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-chef/chef"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestSerialNumberConflict(t *testing.T) {
+	d := newConflictDetector(time.Minute)
+	now := time.Date(2017, 6, 1, 10, 0, 0, 0, time.UTC)
+
+	assert.Empty(t, d.observe("111111", "10.0.0.1", now))
+	assert.Empty(t, d.observe("111111", "10.0.0.1", now.Add(10*time.Second)))
+
+	conflicts := d.observe("111111", "10.0.0.2", now.Add(20*time.Second))
+	if assert.Len(t, conflicts, 1) {
+		assert.Equal(t, SerialNumberConflict, conflicts[0].Kind)
+		assert.Equal(t, "111111", conflicts[0].Key)
+		assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, conflicts[0].Values)
+	}
+
+	event := <-d.events
+	assert.False(t, event.Resolved)
+	assert.Equal(t, "111111", event.Key)
+
+	// The conflict lasts while both addresses are seen
+	assert.Len(t, d.observe("111111", "10.0.0.1", now.Add(50*time.Second)), 1)
+	assert.Len(t, d.conflicts(), 1)
+
+	// 10.0.0.2 not seen for a whole window
+	assert.Empty(t, d.observe("111111", "10.0.0.1", now.Add(90*time.Second)))
+	assert.Empty(t, d.conflicts())
+
+	event = <-d.events
+	assert.True(t, event.Resolved)
+	assert.Equal(t, "111111", event.Key)
+}
+
+func TestAddressConflict(t *testing.T) {
+	d := newConflictDetector(time.Minute)
+	now := time.Date(2017, 6, 1, 10, 0, 0, 0, time.UTC)
+
+	assert.Empty(t, d.observe("111111", "10.0.0.1", now))
+
+	conflicts := d.observe("222222", "10.0.0.1", now.Add(time.Second))
+	if assert.Len(t, conflicts, 1) {
+		assert.Equal(t, AddressConflict, conflicts[0].Kind)
+		assert.Equal(t, "10.0.0.1", conflicts[0].Key)
+		assert.Equal(t, []string{"111111", "222222"}, conflicts[0].Values)
+	}
+
+	// Resolved by the sweep even if the address is not seen again
+	d.observe("333333", "10.0.0.3", now.Add(2*time.Minute))
+	assert.Empty(t, d.conflicts())
+
+	assert.False(t, (<-d.events).Resolved)
+	assert.True(t, (<-d.events).Resolved)
+}
+
+func TestConflictEventsDropped(t *testing.T) {
+	d := newConflictDetector(time.Minute)
+	now := time.Now()
+
+	for i := 0; i < conflictEventsBuffer+10; i++ {
+		serialNumber := strconv.Itoa(i)
+		d.observe(serialNumber, net.IPv4(10, 0, byte(i), 1).String(), now)
+		d.observe(serialNumber, net.IPv4(10, 0, byte(i), 2).String(), now)
+	}
+
+	assert.Len(t, d.conflicts(), conflictEventsBuffer+10)
+	assert.Len(t, d.events, conflictEventsBuffer)
+}
+
+func TestUpdateNodeConflict(t *testing.T) {
+	nodesAPI := new(ChefNodesMock)
+	nodesAPI.On("Get", "sensor-a").Return(sensorNode("sensor-a", "aaaa", "111111"), nil)
+	nodesAPI.On("Put", mock.AnythingOfType("chef.Node")).Return(chef.Node{}, nil)
+
+	node := sensorNode("sensor-a", "aaaa", "111111")
+	chefUpdater := &ChefUpdater{
+		nodes:     newSensorsDB(map[string]*chef.Node{"aaaa": &node}),
+		client:    nodesAPI,
+		conflicts: newConflictDetector(time.Minute),
+		ChefUpdaterConfig: ChefUpdaterConfig{
+			SensorUUIDPath:    "org/uuid",
+			SerialNumberPath:  "org/serial_number",
+			BlockedStatusPath: "org/blocked",
+			IPAddressPath:     "org/ipaddress",
+			ObservationIDPath: "org/observation_id",
+		},
+	}
+
+	assert.NoError(t, chefUpdater.UpdateNode(net.ParseIP("10.0.0.1"), "111111", 10, 999))
+
+	err := chefUpdater.UpdateNode(net.ParseIP("10.0.0.2"), "111111", 10, 999)
+	if assert.IsType(t, &ConflictError{}, err) {
+		assert.Equal(t, SerialNumberConflict, err.(*ConflictError).Kind)
+	}
+
+	attrs, err := getParent(chefUpdater.nodes.get("aaaa").NormalAttributes, "org/ipaddress")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", attrs["ipaddress"])
+
+	assert.Len(t, chefUpdater.Conflicts(), 1)
+	assert.NotNil(t, chefUpdater.ConflictEvents())
+}
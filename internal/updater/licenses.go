@@ -0,0 +1,259 @@
+// Service for allowing new sensors to send flow based on a serial number.
+// Copyright (C) 2017 ENEO Tecnologia SL
+// Author: Diego Fernández Barrear <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package updater
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// License is a license from the licenses data bag.
+type License struct {
+	UUID       string
+	Expires    time.Time // Zero if the license doesn't expire
+	MaxSensors int       // Zero if there is no limit
+}
+
+// Expired checks if the license has expired at the given time.
+func (l License) Expired(now time.Time) bool {
+	return !l.Expires.IsZero() && !now.Before(l.Expires)
+}
+
+// LicensesDataBag is the content of the licenses data bag item. Two schemas
+// are supported, and both may be used on the same item:
+//
+//   - "sensors": License of each sensor, keyed by sensor UUID:
+//     {"sensors": {"<sensor_uuid>": {"license": "<license_uuid>"}}}
+//   - "licenses": Licenses keyed by license UUID, with the UUIDs of their
+//     sensors and optional expiration date and limit of sensors:
+//     {"licenses": {"<license_uuid>": {"expires_at": "2018-01-01T00:00:00Z",
+//     "max_sensors": 10, "sensors": ["<sensor_uuid>"]}}}
+type LicensesDataBag struct {
+	Sensors  map[string]string  // License UUID of each sensor UUID
+	Licenses map[string]License // Licenses by UUID
+}
+
+// parseLicensesDataBag parses the licenses data bag item. Invalid entries are
+// skipped and reported on the returned errors, so a single malformed entry
+// doesn't affect the rest. An error is only returned if the item itself is
+// invalid.
+func parseLicensesDataBag(item interface{}) (LicensesDataBag, []error, error) {
+	dataBag := LicensesDataBag{
+		Sensors:  make(map[string]string),
+		Licenses: make(map[string]License),
+	}
+	var errs []error
+
+	root, ok := item.(map[string]interface{})
+	if !ok {
+		return dataBag, nil, errors.New("Invalid data bag item: not an object")
+	}
+
+	_, hasSensors := root["sensors"]
+	_, hasLicenses := root["licenses"]
+	if !hasSensors && !hasLicenses {
+		return dataBag, nil,
+			errors.New("Invalid data bag item: no \"sensors\" nor \"licenses\"")
+	}
+
+	if hasLicenses {
+		licenses, ok := root["licenses"].(map[string]interface{})
+		if !ok {
+			return dataBag, nil,
+				errors.New("Invalid data bag item: \"licenses\" is not an object")
+		}
+
+		for _, uuid := range sortedKeys(licenses) {
+			license, sensors, err := parseLicense(uuid, licenses[uuid])
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			dataBag.Licenses[uuid] = license
+			for _, sensor := range sensors {
+				errs = append(errs, dataBag.assign(sensor, uuid)...)
+			}
+		}
+	}
+
+	if hasSensors {
+		sensors, ok := root["sensors"].(map[string]interface{})
+		if !ok {
+			return dataBag, nil,
+				errors.New("Invalid data bag item: \"sensors\" is not an object")
+		}
+
+		for _, sensor := range sortedKeys(sensors) {
+			entry, ok := sensors[sensor].(map[string]interface{})
+			if !ok {
+				errs = append(errs, fmt.Errorf("Invalid license of sensor %s: not an object", sensor))
+				continue
+			}
+
+			license, ok := entry["license"].(string)
+			if !ok || len(license) == 0 {
+				errs = append(errs, fmt.Errorf("Invalid license of sensor %s: no license", sensor))
+				continue
+			}
+
+			errs = append(errs, dataBag.assign(sensor, license)...)
+		}
+	}
+
+	errs = append(errs, dataBag.checkLimits()...)
+
+	return dataBag, errs, nil
+}
+
+// assign sets the license of a sensor. A sensor can't have two different
+// licenses, the first one is kept.
+func (d LicensesDataBag) assign(sensor, license string) []error {
+	if current, ok := d.Sensors[sensor]; ok && current != license {
+		return []error{fmt.Errorf("Sensor %s has licenses %s and %s, using %s",
+			sensor, current, license, current)}
+	}
+
+	d.Sensors[sensor] = license
+	return nil
+}
+
+// checkLimits reports the licenses assigned to more sensors than allowed.
+func (d LicensesDataBag) checkLimits() []error {
+	var errs []error
+
+	count := make(map[string]int)
+	for _, license := range d.Sensors {
+		count[license]++
+	}
+
+	for _, uuid := range sortedLicenses(d.Licenses) {
+		license := d.Licenses[uuid]
+		if license.MaxSensors > 0 && count[uuid] > license.MaxSensors {
+			errs = append(errs, fmt.Errorf("License %s has %d sensors, limit is %d",
+				uuid, count[uuid], license.MaxSensors))
+		}
+	}
+
+	return errs
+}
+
+// parseLicense parses an entry of the "licenses" object. Returns the license
+// and the UUIDs of its sensors.
+func parseLicense(uuid string, raw interface{}) (License, []string, error) {
+	license := License{UUID: uuid}
+
+	entry, ok := raw.(map[string]interface{})
+	if !ok {
+		return license, nil, fmt.Errorf("Invalid license %s: not an object", uuid)
+	}
+
+	if expires, ok := entry["expires_at"]; ok {
+		t, err := parseTime(expires)
+		if err != nil {
+			return license, nil, fmt.Errorf("Invalid license %s: expires_at: %s",
+				uuid, err.Error())
+		}
+		license.Expires = t
+	}
+
+	if max, ok := entry["max_sensors"]; ok {
+		n, err := parseInt(max)
+		if err != nil || n < 0 {
+			return license, nil,
+				fmt.Errorf("Invalid license %s: max_sensors must be a positive integer", uuid)
+		}
+		license.MaxSensors = int(n)
+	}
+
+	var sensors []string
+	if rawSensors, ok := entry["sensors"]; ok {
+		list, ok := rawSensors.([]interface{})
+		if !ok {
+			return license, nil,
+				fmt.Errorf("Invalid license %s: sensors must be a list", uuid)
+		}
+
+		for _, s := range list {
+			sensor, ok := s.(string)
+			if !ok || len(sensor) == 0 {
+				return license, nil,
+					fmt.Errorf("Invalid license %s: invalid sensor UUID %v", uuid, s)
+			}
+			sensors = append(sensors, sensor)
+		}
+	}
+
+	return license, sensors, nil
+}
+
+// parseTime parses a RFC 3339 date or a number of seconds since epoch.
+func parseTime(value interface{}) (time.Time, error) {
+	if s, ok := value.(string); ok {
+		return time.Parse(time.RFC3339, s)
+	}
+
+	seconds, err := parseInt(value)
+	if err != nil {
+		return time.Time{}, errors.New("not a date")
+	}
+
+	return time.Unix(seconds, 0), nil
+}
+
+// parseInt parses a JSON integer.
+func parseInt(value interface{}) (int64, error) {
+	switch n := value.(type) {
+	case float64:
+		if n != float64(int64(n)) {
+			return 0, errors.New("not an integer")
+		}
+		return int64(n), nil
+	case json.Number:
+		return n.Int64()
+	case int:
+		return int64(n), nil
+	case int64:
+		return n, nil
+	}
+
+	return 0, errors.New("not an integer")
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func sortedLicenses(m map[string]License) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,280 @@
+// Service for allowing new sensors to send flow based on a serial number.
+// Copyright (C) 2017 ENEO Tecnologia SL
+// Author: Diego Fernández Barrear <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package updater
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-chef/chef"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestParseLicensesDataBagSensors(t *testing.T) {
+	dataBag, errs, err := parseLicensesDataBag(map[string]interface{}{
+		"sensors": map[string]interface{}{
+			"aaaa": map[string]interface{}{"license": "l1"},
+			"bbbb": map[string]interface{}{"license": 1234},
+			"cccc": "l2",
+			"dddd": map[string]interface{}{"license": "l2"},
+		},
+	})
+
+	assert.NoError(t, err)
+	assert.Len(t, errs, 2)
+	assert.Equal(t, map[string]string{"aaaa": "l1", "dddd": "l2"}, dataBag.Sensors)
+}
+
+func TestParseLicensesDataBagLicenses(t *testing.T) {
+	dataBag, errs, err := parseLicensesDataBag(map[string]interface{}{
+		"licenses": map[string]interface{}{
+			"l1": map[string]interface{}{
+				"expires_at":  "2018-01-01T00:00:00Z",
+				"max_sensors": float64(1),
+				"sensors":     []interface{}{"aaaa", "bbbb"},
+			},
+			"l2": map[string]interface{}{
+				"expires_at": float64(1500000000),
+				"sensors":    []interface{}{"cccc"},
+			},
+			"l3": map[string]interface{}{
+				"expires_at": "tomorrow",
+			},
+			"l4": map[string]interface{}{
+				"max_sensors": float64(-1),
+			},
+		},
+		"sensors": map[string]interface{}{
+			"cccc": map[string]interface{}{"license": "l1"},
+			"dddd": map[string]interface{}{"license": "l2"},
+		},
+	})
+
+	assert.NoError(t, err)
+
+	// l3, l4, "cccc" with two licenses and l1 over its limit
+	assert.Len(t, errs, 4)
+
+	assert.Equal(t, map[string]string{
+		"aaaa": "l1",
+		"bbbb": "l1",
+		"cccc": "l2",
+		"dddd": "l2",
+	}, dataBag.Sensors)
+
+	assert.Equal(t, License{
+		UUID:       "l1",
+		Expires:    time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC),
+		MaxSensors: 1,
+	}, dataBag.Licenses["l1"])
+	assert.Equal(t, time.Unix(1500000000, 0), dataBag.Licenses["l2"].Expires)
+	assert.NotContains(t, dataBag.Licenses, "l3")
+	assert.NotContains(t, dataBag.Licenses, "l4")
+}
+
+func TestParseLicensesDataBagInvalid(t *testing.T) {
+	_, _, err := parseLicensesDataBag("licenses")
+	assert.Error(t, err)
+
+	_, _, err = parseLicensesDataBag(map[string]interface{}{})
+	assert.Error(t, err)
+
+	_, _, err = parseLicensesDataBag(map[string]interface{}{"sensors": []interface{}{}})
+	assert.Error(t, err)
+}
+
+func TestLicenseExpired(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+
+	assert.False(t, License{}.Expired(now))
+	assert.False(t, License{Expires: now.Add(time.Second)}.Expired(now))
+	assert.True(t, License{Expires: now}.Expired(now))
+}
+
+func TestFetchLicenses(t *testing.T) {
+	dataBagsAPI := new(ChefDataBagsMock)
+	dataBagsAPI.On("GetItem", "rBglobal", "licenses").Return(
+		map[string]interface{}{
+			"sensors": map[string]interface{}{
+				"aaaa": map[string]interface{}{"license": "l1"},
+				"bbbb": nil,
+			},
+		}, nil)
+
+	chefUpdater := &ChefUpdater{
+		dataBags: dataBagsAPI,
+		ChefUpdaterConfig: ChefUpdaterConfig{
+			BlockedStatusPath: "redborder/blocked",
+			LicenseUUIDPath:   "org/license_uuid",
+			DataBagName:       "rBglobal",
+			DataBagItem:       "licenses",
+		},
+	}
+
+	node := sensorNode("sensor-a", "aaaa", "111111")
+	var summary FetchSummary
+
+	_, err := chefUpdater.fetchLicenses(map[string]*chef.Node{"aaaa": &node}, &summary)
+	assert.NoError(t, err)
+	assert.Len(t, summary.Errors, 1)
+
+	license, ok := getString(node.NormalAttributes, "org/license_uuid")
+	assert.True(t, ok)
+	assert.Equal(t, "l1", license)
+	assert.NotContains(t,
+		node.NormalAttributes["redborder"].(map[string]interface{}), "license_uuid")
+}
+
+func TestCheckLicenseExpiry(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+
+	licensedNode := func(name, uuid, license string, blocked bool) *chef.Node {
+		node := sensorNode(name, uuid, "")
+		org := node.NormalAttributes["org"].(map[string]interface{})
+		org["license_uuid"] = license
+		org["blocked"] = blocked
+		return &node
+	}
+
+	chefUpdater := &ChefUpdater{
+		nodes: newSensorsDB(map[string]*chef.Node{
+			"aaaa": licensedNode("sensor-a", "aaaa", "valid", false),
+			"bbbb": licensedNode("sensor-b", "bbbb", "expired", false),
+			"cccc": licensedNode("sensor-c", "cccc", "grace", false),
+			"dddd": licensedNode("sensor-d", "dddd", "expired", true),
+			"eeee": licensedNode("sensor-e", "eeee", "valid", true),
+		}),
+		ChefUpdaterConfig: ChefUpdaterConfig{
+			SensorUUIDPath:     "org/uuid",
+			BlockedStatusPath:  "org/blocked",
+			LicenseUUIDPath:    "org/license_uuid",
+			CheckLicenseExpiry: true,
+			LicenseGracePeriod: time.Hour,
+			LicenseExpiredPath: "org/license_expired",
+		},
+	}
+
+	licenses := map[string]License{
+		"valid":   {UUID: "valid", Expires: now.Add(time.Hour)},
+		"expired": {UUID: "expired", Expires: now.Add(-2 * time.Hour)},
+		"grace":   {UUID: "grace", Expires: now.Add(-time.Minute)},
+	}
+
+	blocked := func(uuid string) bool {
+		value, _ := getParent(chefUpdater.nodes.get(uuid).NormalAttributes, "org/blocked")
+		return value["blocked"].(bool)
+	}
+
+	flagged := func(uuid string) bool {
+		value, _ := getParent(chefUpdater.nodes.get(uuid).NormalAttributes, "org/license_expired")
+		return value["license_expired"] == true
+	}
+
+	// Sensors already blocked are flagged too
+	var summary FetchSummary
+	chefUpdater.checkLicenseExpiry(licenses, now, &summary)
+	assert.Equal(t, 2, summary.Expired)
+	assert.Empty(t, summary.Errors)
+	assert.False(t, blocked("aaaa"))
+	assert.True(t, blocked("bbbb"))
+	assert.False(t, blocked("cccc"))
+	assert.True(t, blocked("dddd"))
+	assert.True(t, flagged("dddd"))
+	assert.False(t, flagged("eeee"))
+
+	// Renewed licenses only unblock the sensors blocked because of them
+	licenses["expired"] = License{UUID: "expired", Expires: now.Add(time.Hour)}
+
+	summary = FetchSummary{}
+	chefUpdater.checkLicenseExpiry(licenses, now.Add(time.Hour), &summary)
+	assert.Equal(t, 1, summary.Expired)
+	assert.Equal(t, 2, summary.Renewed)
+	assert.False(t, blocked("bbbb"))
+	assert.True(t, blocked("cccc"))
+	assert.False(t, blocked("dddd"))
+	assert.True(t, blocked("eeee"))
+
+	// Sensors with an expired license are not unblocked by the allowed licenses
+	_, errs := chefUpdater.ReconcileLicenses([]string{"valid", "expired", "grace"}, "")
+	assert.Empty(t, errs)
+	assert.False(t, blocked("bbbb"))
+	assert.True(t, blocked("cccc"))
+
+	// Licenses missing from the data bag don't unblock the sensors
+	delete(licenses, "grace")
+
+	summary = FetchSummary{}
+	chefUpdater.checkLicenseExpiry(licenses, now.Add(time.Hour), &summary)
+	assert.Equal(t, 0, summary.Renewed)
+	assert.True(t, blocked("cccc"))
+
+	// The expiration is stored on the node, so renewed licenses unblock the
+	// sensors after a restart
+	restarted := &ChefUpdater{
+		nodes:             chefUpdater.nodes,
+		ChefUpdaterConfig: chefUpdater.ChefUpdaterConfig,
+	}
+	licenses["grace"] = License{UUID: "grace"}
+
+	summary = FetchSummary{}
+	restarted.checkLicenseExpiry(licenses, now.Add(time.Hour), &summary)
+	assert.Equal(t, 0, summary.Expired)
+	assert.Equal(t, 1, summary.Renewed)
+	assert.False(t, blocked("cccc"))
+}
+
+func TestFetchNodesKeepsLicenses(t *testing.T) {
+	nodesAPI := new(ChefNodesMock)
+	nodesAPI.On("List").Return(map[string]string{"sensor-a": ""}, nil)
+	nodesAPI.On("Get", "sensor-a").Return(sensorNode("sensor-a", "aaaa", "111111"), nil)
+
+	dataBagsAPI := new(ChefDataBagsMock)
+	dataBagsAPI.On("GetItem", "rBglobal", "licenses").Return(nil, errors.New("Chef down"))
+
+	previous := sensorNode("sensor-a", "aaaa", "111111")
+	previous.NormalAttributes["org"].(map[string]interface{})["license_uuid"] = "l1"
+
+	chefUpdater := &ChefUpdater{
+		nodes:    newSensorsDB(map[string]*chef.Node{"aaaa": &previous}),
+		client:   nodesAPI,
+		dataBags: dataBagsAPI,
+		ChefUpdaterConfig: ChefUpdaterConfig{
+			SensorUUIDPath:    "org/uuid",
+			BlockedStatusPath: "org/blocked",
+			LicenseUUIDPath:   "org/license_uuid",
+			DataBagName:       "rBglobal",
+			DataBagItem:       "licenses",
+		},
+	}
+
+	_, err := chefUpdater.FetchNodes()
+	assert.Error(t, err)
+
+	node := chefUpdater.nodes.get("aaaa")
+	assert.False(t, node.Node == &previous)
+	license, _ := getString(node.NormalAttributes, "org/license_uuid")
+	assert.Equal(t, "l1", license)
+
+	// Licensed sensors are not blocked meanwhile
+	summary, errs := chefUpdater.ReconcileLicenses([]string{"l1"}, "")
+	assert.Empty(t, errs)
+	assert.Equal(t, 1, summary.Unchanged)
+	nodesAPI.AssertNotCalled(t, "Put", mock.Anything)
+}
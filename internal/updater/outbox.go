@@ -0,0 +1,301 @@
+// Service for allowing new sensors to send flow based on a serial number.
+// Copyright (C) 2017 ENEO Tecnologia SL
+// Author: Diego Fernández Barrear <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package updater
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+)
+
+// outboxCompactThreshold is the number of delivered records kept on the
+// outbox file before it's rewritten with only the pending ones.
+const outboxCompactThreshold = 1000
+
+// outboxEntry is a pending change of a node attribute. Entries are stored on
+// the outbox file as JSON lines. Records with "done" set mark the previous
+// changes of the same attribute as delivered.
+type outboxEntry struct {
+	Seq     uint64      `json:"seq"`
+	Node    string      `json:"node"`
+	Path    string      `json:"path"`
+	Value   interface{} `json:"value,omitempty"`
+	Trigger string      `json:"trigger,omitempty"`
+	Done    bool        `json:"done,omitempty"`
+}
+
+type outboxKey struct {
+	node string
+	path string
+}
+
+// outbox is an append-only log of changes that have not been sent to Chef yet.
+// Only the last change of each node attribute is kept, so the outbox size
+// depends on the number of nodes and not on the number of changes.
+type outbox struct {
+	mu      sync.Mutex
+	file    *os.File
+	path    string
+	seq     uint64
+	records int
+	entries map[outboxKey]outboxEntry
+}
+
+// openOutbox opens an outbox file, creating it if it doesn't exist, and loads
+// the pending changes.
+func openOutbox(path string) (*outbox, error) {
+	o := &outbox{
+		path:    path,
+		entries: make(map[outboxKey]outboxEntry),
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, errors.New("Error opening outbox: " + err.Error())
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry outboxEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A partially written record after a crash is the last one
+			log.Warnf("Ignoring invalid outbox record: %s", err.Error())
+			continue
+		}
+
+		o.apply(entry)
+		o.records++
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, errors.New("Error reading outbox: " + err.Error())
+	}
+
+	o.file = file
+	return o, nil
+}
+
+// apply updates the pending changes with a record.
+func (o *outbox) apply(entry outboxEntry) {
+	if entry.Seq > o.seq {
+		o.seq = entry.Seq
+	}
+
+	key := outboxKey{entry.Node, entry.Path}
+	if !entry.Done {
+		o.entries[key] = entry
+		return
+	}
+
+	if pending, ok := o.entries[key]; ok && pending.Seq <= entry.Seq {
+		delete(o.entries, key)
+	}
+}
+
+// add stores the new values of some attributes of a node and what caused
+// them, replacing the pending changes of the same attributes.
+func (o *outbox) add(node, trigger string, changes map[string]interface{}) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	paths := make([]string, 0, len(changes))
+	for path := range changes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	records := make([]outboxEntry, 0, len(paths))
+	for _, path := range paths {
+		o.seq++
+		records = append(records, outboxEntry{
+			Seq:     o.seq,
+			Node:    node,
+			Path:    path,
+			Value:   changes[path],
+			Trigger: trigger,
+		})
+	}
+
+	return o.write(records)
+}
+
+// done marks some changes as delivered. Changes made after them are kept.
+func (o *outbox) done(entries []outboxEntry) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	records := make([]outboxEntry, 0, len(entries))
+	for _, entry := range entries {
+		records = append(records, outboxEntry{
+			Seq:  entry.Seq,
+			Node: entry.Node,
+			Path: entry.Path,
+			Done: true,
+		})
+	}
+
+	if err := o.write(records); err != nil {
+		return err
+	}
+
+	if o.records-len(o.entries) > outboxCompactThreshold {
+		return o.compact()
+	}
+
+	return nil
+}
+
+// pending returns the pending changes of a node.
+func (o *outbox) pending(node string) []outboxEntry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var entries []outboxEntry
+	for key, entry := range o.entries {
+		if key.node == node {
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.Sort(bySeq(entries))
+	return entries
+}
+
+// nodes returns the nodes with pending changes, sorted by their oldest change.
+func (o *outbox) nodes() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	entries := make([]outboxEntry, 0, len(o.entries))
+	for _, entry := range o.entries {
+		entries = append(entries, entry)
+	}
+	sort.Sort(bySeq(entries))
+
+	var nodes []string
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		if !seen[entry.Node] {
+			seen[entry.Node] = true
+			nodes = append(nodes, entry.Node)
+		}
+	}
+
+	return nodes
+}
+
+// len returns the number of pending changes.
+func (o *outbox) len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return len(o.entries)
+}
+
+// close closes the outbox file. Pending changes are loaded again when the
+// outbox is opened.
+func (o *outbox) close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.file.Close()
+}
+
+// write appends records to the outbox file and applies them. The file is
+// synced so the records are not lost on a crash.
+func (o *outbox) write(records []outboxEntry) error {
+	var buf []byte
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return errors.New("Error encoding outbox record: " + err.Error())
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+
+	if _, err := o.file.Write(buf); err != nil {
+		return errors.New("Error writing outbox: " + err.Error())
+	}
+	if err := o.file.Sync(); err != nil {
+		return errors.New("Error writing outbox: " + err.Error())
+	}
+
+	for _, record := range records {
+		o.apply(record)
+	}
+	o.records += len(records)
+
+	return nil
+}
+
+// compact rewrites the outbox file with only the pending changes.
+func (o *outbox) compact() error {
+	entries := make([]outboxEntry, 0, len(o.entries))
+	for _, entry := range o.entries {
+		entries = append(entries, entry)
+	}
+	sort.Sort(bySeq(entries))
+
+	tmpPath := o.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.New("Error compacting outbox: " + err.Error())
+	}
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			tmp.Close()
+			return errors.New("Error compacting outbox: " + err.Error())
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return errors.New("Error compacting outbox: " + err.Error())
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.New("Error compacting outbox: " + err.Error())
+	}
+	tmp.Close()
+
+	if err := os.Rename(tmpPath, o.path); err != nil {
+		return errors.New("Error compacting outbox: " + err.Error())
+	}
+
+	file, err := os.OpenFile(o.path, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.New("Error compacting outbox: " + err.Error())
+	}
+
+	o.file.Close()
+	o.file = file
+	o.records = len(entries)
+
+	return nil
+}
+
+type bySeq []outboxEntry
+
+func (s bySeq) Len() int           { return len(s) }
+func (s bySeq) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s bySeq) Less(i, j int) bool { return s[i].Seq < s[j].Seq }
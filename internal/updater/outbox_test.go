@@ -0,0 +1,134 @@
+// Service for allowing new sensors to send flow based on a serial number.
+// Copyright (C) 2017 ENEO Tecnologia SL
+// Author: Diego Fernández Barrear <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package updater
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tempOutboxPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return filepath.Join(dir, "outbox.log"), func() { os.RemoveAll(dir) }
+}
+
+func TestOutboxCoalesce(t *testing.T) {
+	path, cleanup := tempOutboxPath(t)
+	defer cleanup()
+
+	o, err := openOutbox(path)
+	assert.NoError(t, err)
+	defer o.close()
+
+	assert.NoError(t, o.add("sensor-a", "", map[string]interface{}{
+		"org/blocked":   true,
+		"org/ipaddress": "10.0.0.1",
+	}))
+	assert.NoError(t, o.add("sensor-b", "", map[string]interface{}{
+		"org/blocked": true,
+	}))
+	assert.NoError(t, o.add("sensor-a", "", map[string]interface{}{
+		"org/blocked": false,
+	}))
+
+	assert.Equal(t, 3, o.len())
+	assert.Equal(t, []string{"sensor-a", "sensor-b"}, o.nodes())
+
+	pending := o.pending("sensor-a")
+	if assert.Len(t, pending, 2) {
+		assert.Equal(t, "org/ipaddress", pending[0].Path)
+		assert.Equal(t, "org/blocked", pending[1].Path)
+		assert.Equal(t, false, pending[1].Value)
+	}
+}
+
+func TestOutboxDone(t *testing.T) {
+	path, cleanup := tempOutboxPath(t)
+	defer cleanup()
+
+	o, err := openOutbox(path)
+	assert.NoError(t, err)
+	defer o.close()
+
+	assert.NoError(t, o.add("sensor-a", "", map[string]interface{}{"org/blocked": true}))
+	delivered := o.pending("sensor-a")
+
+	// Changed again while the previous change was being delivered
+	assert.NoError(t, o.add("sensor-a", "", map[string]interface{}{"org/blocked": false}))
+	assert.NoError(t, o.done(delivered))
+
+	pending := o.pending("sensor-a")
+	if assert.Len(t, pending, 1) {
+		assert.Equal(t, false, pending[0].Value)
+	}
+
+	assert.NoError(t, o.done(pending))
+	assert.Equal(t, 0, o.len())
+}
+
+func TestOutboxReopen(t *testing.T) {
+	path, cleanup := tempOutboxPath(t)
+	defer cleanup()
+
+	o, err := openOutbox(path)
+	assert.NoError(t, err)
+
+	assert.NoError(t, o.add("sensor-a", "", map[string]interface{}{"org/blocked": true}))
+	assert.NoError(t, o.add("sensor-b", "", map[string]interface{}{"org/blocked": true}))
+	assert.NoError(t, o.done(o.pending("sensor-a")))
+	assert.NoError(t, o.close())
+
+	o, err = openOutbox(path)
+	assert.NoError(t, err)
+	defer o.close()
+
+	assert.Equal(t, []string{"sensor-b"}, o.nodes())
+	assert.NoError(t, o.add("sensor-c", "", map[string]interface{}{"org/blocked": true}))
+	assert.Equal(t, []string{"sensor-b", "sensor-c"}, o.nodes())
+}
+
+func TestOutboxCompact(t *testing.T) {
+	path, cleanup := tempOutboxPath(t)
+	defer cleanup()
+
+	o, err := openOutbox(path)
+	assert.NoError(t, err)
+
+	assert.NoError(t, o.add("sensor-a", "", map[string]interface{}{"org/blocked": true}))
+	for i := 0; i < outboxCompactThreshold; i++ {
+		assert.NoError(t, o.add("sensor-b", "", map[string]interface{}{"org/blocked": true}))
+		assert.NoError(t, o.done(o.pending("sensor-b")))
+	}
+
+	assert.True(t, o.records < outboxCompactThreshold)
+	assert.NoError(t, o.close())
+
+	o, err = openOutbox(path)
+	assert.NoError(t, err)
+	defer o.close()
+
+	assert.Equal(t, []string{"sensor-a"}, o.nodes())
+}
@@ -0,0 +1,98 @@
+// Service for allowing new sensors to send flow based on a serial number.
+// Copyright (C) 2017 ENEO Tecnologia SL
+// Author: Diego Fernández Barrear <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package updater
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// GenericProductType is the product type of the nodes without one.
+const GenericProductType = 999
+
+// ProductTypePolicy decides which product types are accepted on the flow and
+// how they are matched with the product types of the nodes.
+type ProductTypePolicy struct {
+	// Valid are the product types accepted on the flow. Any product type is
+	// accepted if empty.
+	Valid []uint32
+
+	// Wildcards are the product types that match any other product type.
+	Wildcards []uint32
+
+	// RejectMissing rejects the nodes without product type instead of using
+	// GenericProductType.
+	RejectMissing bool
+}
+
+// valid checks if a product type is accepted on the flow.
+func (p ProductTypePolicy) valid(productType uint32) bool {
+	return len(p.Valid) == 0 || containsProductType(p.Valid, productType) ||
+		containsProductType(p.Wildcards, productType)
+}
+
+// match checks if two product types match.
+func (p ProductTypePolicy) match(a, b uint32) bool {
+	return a == b || containsProductType(p.Wildcards, a) ||
+		containsProductType(p.Wildcards, b)
+}
+
+// matchAny checks if a product type matches one of the given product types.
+func (p ProductTypePolicy) matchAny(productType uint32, productTypes []uint32) bool {
+	for _, other := range productTypes {
+		if p.match(productType, other) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nodeProductType returns the product type of a node from the attribute on
+// the Chef node, which may be missing.
+func (p ProductTypePolicy) nodeProductType(value interface{}) (uint32, error) {
+	if value == nil {
+		if p.RejectMissing {
+			return 0, errors.New("Missing Product Type")
+		}
+		return GenericProductType, nil
+	}
+
+	str, ok := value.(string)
+	if !ok {
+		return 0, errors.New("Product Type is not string")
+	}
+
+	productType, err := strconv.ParseUint(str, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid Product Type %q", str)
+	}
+
+	return uint32(productType), nil
+}
+
+func containsProductType(productTypes []uint32, productType uint32) bool {
+	for _, p := range productTypes {
+		if p == productType {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,132 @@
+// Service for allowing new sensors to send flow based on a serial number.
+// Copyright (C) 2017 ENEO Tecnologia SL
+// Author: Diego Fernández Barrear <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package updater
+
+import (
+	"net"
+	"testing"
+
+	"github.com/go-chef/chef"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestProductTypePolicy(t *testing.T) {
+	policy := ProductTypePolicy{
+		Valid:     []uint32{1, 2},
+		Wildcards: []uint32{100},
+	}
+
+	assert.True(t, policy.valid(1))
+	assert.True(t, policy.valid(100))
+	assert.False(t, policy.valid(3))
+	assert.True(t, ProductTypePolicy{}.valid(3))
+
+	assert.True(t, policy.match(1, 1))
+	assert.False(t, policy.match(1, 2))
+	assert.True(t, policy.match(100, 2))
+	assert.True(t, policy.match(1, 100))
+
+	assert.True(t, policy.matchAny(2, []uint32{1, 2}))
+	assert.False(t, policy.matchAny(2, []uint32{1}))
+	assert.False(t, policy.matchAny(2, nil))
+}
+
+func TestNodeProductType(t *testing.T) {
+	productType, err := ProductTypePolicy{}.nodeProductType(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(GenericProductType), productType)
+
+	_, err = ProductTypePolicy{RejectMissing: true}.nodeProductType(nil)
+	assert.Error(t, err)
+
+	productType, err = ProductTypePolicy{}.nodeProductType("123")
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(123), productType)
+
+	_, err = ProductTypePolicy{}.nodeProductType("abc")
+	assert.Error(t, err)
+	_, err = ProductTypePolicy{}.nodeProductType(123)
+	assert.Error(t, err)
+}
+
+func TestUpdateNodeProductTypes(t *testing.T) {
+	nodesAPI := new(ChefNodesMock)
+	nodesAPI.On("Get", "sensor-a").Return(sensorNode("sensor-a", "aaaa", "111111"), nil)
+	nodesAPI.On("Put", mock.AnythingOfType("chef.Node")).Return(chef.Node{}, nil)
+
+	node := sensorNode("sensor-a", "aaaa", "111111")
+	setAttribute(node.NormalAttributes, "org/product_type", "5")
+	chefUpdater := &ChefUpdater{
+		nodes:  newSensorsDB(map[string]*chef.Node{"aaaa": &node}),
+		client: nodesAPI,
+		ChefUpdaterConfig: ChefUpdaterConfig{
+			SensorUUIDPath:    "org/uuid",
+			SerialNumberPath:  "org/serial_number",
+			BlockedStatusPath: "org/blocked",
+			IPAddressPath:     "org/ipaddress",
+			ObservationIDPath: "org/observation_id",
+			ProductTypePath:   "org/product_type",
+			ProductTypes: ProductTypePolicy{
+				Valid:     []uint32{5, 6},
+				Wildcards: []uint32{0},
+			},
+		},
+	}
+
+	address := net.ParseIP("10.0.0.1")
+	assert.Error(t, chefUpdater.UpdateNode(address, "111111", 10, 7))
+	assert.Error(t, chefUpdater.UpdateNode(address, "111111", 10, 6))
+	assert.NoError(t, chefUpdater.UpdateNode(address, "111111", 10, 5))
+	assert.NoError(t, chefUpdater.UpdateNode(address, "111111", 11, 0))
+
+	// Nodes without product type
+	attrs, _ := getParent(node.NormalAttributes, "org/product_type")
+	delete(attrs, "product_type")
+	chefUpdater.ProductTypes.RejectMissing = true
+	assert.Error(t, chefUpdater.UpdateNode(address, "111111", 12, 5))
+}
+
+func TestBlockOrganizationProductTypes(t *testing.T) {
+	chefUpdater := &ChefUpdater{
+		nodes: newSensorsDB(bootstrapSensorsDB(), "org/organization_uuid"),
+		ChefUpdaterConfig: ChefUpdaterConfig{
+			SensorUUIDPath:       "org/uuid",
+			BlockedStatusPath:    "org/blocked",
+			OrganizationUUIDPath: "org/organization_uuid",
+			ProductTypePath:      "org/product_type",
+			ProductTypes: ProductTypePolicy{
+				Wildcards: []uint32{0},
+			},
+		},
+	}
+
+	attributes, err := getParent(chefUpdater.nodes.get("2").NormalAttributes,
+		chefUpdater.BlockedStatusPath)
+	assert.NoError(t, err)
+
+	// Sensor "2" has product type 123
+	assert.Empty(t, chefUpdater.BlockOrganization("fghij", []uint32{1, 2}, ""))
+	assert.False(t, attributes["blocked"].(bool))
+
+	assert.Empty(t, chefUpdater.BlockOrganization("fghij", []uint32{1, 123}, ""))
+	assert.True(t, attributes["blocked"].(bool))
+
+	assert.Empty(t, chefUpdater.UnblockOrganization("fghij", []uint32{0}, ""))
+	assert.False(t, attributes["blocked"].(bool))
+}
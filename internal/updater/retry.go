@@ -0,0 +1,395 @@
+// Service for allowing new sensors to send flow based on a serial number.
+// Copyright (C) 2017 ENEO Tecnologia SL
+// Author: Diego Fernández Barrear <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package updater
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/go-chef/chef"
+)
+
+// ErrCircuitOpen is returned instead of sending a request to the Chef server
+// after too many consecutive failures.
+var ErrCircuitOpen = errors.New("Chef API unavailable: circuit breaker open")
+
+// RetryConfig contains the configuration for retrying failed requests to the
+// Chef API. Zero values are replaced by the defaults. A negative MaxRetries or
+// Budget disables retries.
+type RetryConfig struct {
+	MaxRetries       int           // Retries of a single request
+	InitialBackoff   time.Duration // Wait before the first retry, doubled on each retry
+	MaxBackoff       time.Duration // Maximum wait between retries
+	Budget           int           // Retries allowed per minute for all requests
+	BreakerThreshold int           // Consecutive failures that open the circuit
+	BreakerCooldown  time.Duration // Time the circuit stays open
+}
+
+// withDefaults returns a copy of the configuration with the unset values
+// replaced by the defaults and the disabled ones set to zero.
+func (c RetryConfig) withDefaults() RetryConfig {
+	if c.MaxRetries == 0 {
+		c.MaxRetries = 3
+	} else if c.MaxRetries < 0 {
+		c.MaxRetries = 0
+	}
+	if c.InitialBackoff == 0 {
+		c.InitialBackoff = 500 * time.Millisecond
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = 10 * time.Second
+	}
+	if c.Budget == 0 {
+		c.Budget = 60
+	} else if c.Budget < 0 {
+		c.Budget = 0
+	}
+	if c.BreakerThreshold == 0 {
+		c.BreakerThreshold = 5
+	}
+	if c.BreakerCooldown == 0 {
+		c.BreakerCooldown = 30 * time.Second
+	}
+
+	return c
+}
+
+////////////////////
+// circuitBreaker //
+////////////////////
+
+// circuitBreaker stops sending requests to the Chef server after a number of
+// consecutive failures. Once the cooldown has passed requests are allowed
+// again, and the circuit is closed on the first success or opened again on the
+// first failure.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	open      bool
+	failures  int
+	openUntil time.Time
+
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// allow returns ErrCircuitOpen if requests are not allowed.
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.open && b.now().Before(b.openUntil) {
+		return ErrCircuitOpen
+	}
+
+	return nil
+}
+
+// success closes the circuit.
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.open {
+		log.Infoln("Chef API available, circuit breaker closed")
+	}
+
+	b.open = false
+	b.failures = 0
+}
+
+// failure opens the circuit if the threshold has been reached or if the
+// circuit was already open.
+func (b *circuitBreaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if !b.open && b.failures < b.threshold {
+		return
+	}
+
+	if !b.open {
+		log.Warnf("Chef API unavailable after %d failures, circuit breaker open",
+			b.failures)
+	}
+
+	b.open = true
+	b.openUntil = b.now().Add(b.cooldown)
+}
+
+// remaining returns the time until requests are allowed again.
+func (b *circuitBreaker) remaining() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open {
+		return 0
+	}
+
+	return b.openUntil.Sub(b.now())
+}
+
+/////////////
+// retrier //
+/////////////
+
+// retrier executes requests to the Chef API retrying the failed ones with
+// exponential backoff. The retries of all requests share a budget, so a Chef
+// server that is down is not flooded with retries.
+type retrier struct {
+	mu          sync.Mutex
+	budget      int
+	budgetReset time.Time
+
+	breaker *circuitBreaker
+	sleep   func(time.Duration)
+
+	RetryConfig
+}
+
+func newRetrier(config RetryConfig) *retrier {
+	config = config.withDefaults()
+
+	return &retrier{
+		breaker:     newCircuitBreaker(config.BreakerThreshold, config.BreakerCooldown),
+		sleep:       time.Sleep,
+		RetryConfig: config,
+	}
+}
+
+// withoutRetries returns a retrier that sends every request once. It shares
+// the circuit breaker with the original one.
+func (r *retrier) withoutRetries() *retrier {
+	config := r.RetryConfig
+	config.MaxRetries = 0
+
+	return &retrier{
+		breaker:     r.breaker,
+		sleep:       r.sleep,
+		RetryConfig: config,
+	}
+}
+
+// do executes a request until it succeeds, fails with an error that is not
+// worth retrying, or the retries are exhausted.
+func (r *retrier) do(request func() error) error {
+	backoff := r.InitialBackoff
+
+	for attempt := 0; ; attempt++ {
+		if err := r.breaker.allow(); err != nil {
+			return err
+		}
+
+		err := request()
+		if !isRetryable(err) {
+			r.breaker.success()
+			return err
+		}
+
+		r.breaker.failure()
+
+		if attempt >= r.MaxRetries {
+			return err
+		}
+		if !r.takeRetry() {
+			log.Warnln("Chef API retry budget exhausted")
+			return err
+		}
+
+		log.Warnf("Chef request failed, retrying in %s: %s", backoff, err.Error())
+		r.sleep(backoff)
+
+		backoff *= 2
+		if backoff > r.MaxBackoff {
+			backoff = r.MaxBackoff
+		}
+	}
+}
+
+// takeRetry consumes a retry from the budget. Returns false if there are no
+// retries left for the current minute.
+func (r *retrier) takeRetry() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.breaker.now()
+	if now.After(r.budgetReset) {
+		r.budget = r.Budget
+		r.budgetReset = now.Add(time.Minute)
+	}
+
+	if r.budget == 0 {
+		return false
+	}
+
+	r.budget--
+	return true
+}
+
+// isRetryable checks if a failed request may succeed if it's sent again. Only
+// network errors, such as timeouts or refused connections, and server errors
+// from the Chef server are retried. Other errors, such as responses that can't
+// be decoded, fail again if the request is repeated.
+func isRetryable(err error) bool {
+	if err == nil || err == ErrCircuitOpen {
+		return false
+	}
+
+	switch err := err.(type) {
+	case *chef.ErrorResponse:
+		if err.Response == nil {
+			return false
+		}
+
+		status := err.Response.StatusCode
+		return status >= http.StatusInternalServerError ||
+			status == http.StatusTooManyRequests
+	case *url.Error:
+		return isRetryable(err.Err)
+	case net.Error:
+		return true
+	}
+
+	return false
+}
+
+//////////////
+// Services //
+//////////////
+
+// retryingNodesService retries the failed requests to the nodes endpoint.
+type retryingNodesService struct {
+	ChefNodesService
+	*retrier
+}
+
+func (s retryingNodesService) List() (nodes map[string]string, err error) {
+	err = s.do(func() error {
+		nodes, err = s.ChefNodesService.List()
+		return err
+	})
+
+	return nodes, err
+}
+
+func (s retryingNodesService) Get(name string) (node chef.Node, err error) {
+	err = s.do(func() error {
+		node, err = s.ChefNodesService.Get(name)
+		return err
+	})
+
+	return node, err
+}
+
+func (s retryingNodesService) Put(node chef.Node) (result chef.Node, err error) {
+	err = s.do(func() error {
+		result, err = s.ChefNodesService.Put(node)
+		return err
+	})
+
+	return result, err
+}
+
+func (s retryingNodesService) Post(node chef.Node) (result *chef.NodeResult, err error) {
+	err = s.do(func() error {
+		result, err = s.ChefNodesService.Post(node)
+		return err
+	})
+
+	return result, err
+}
+
+// retryingDataBagsService retries the failed requests to the data bags
+// endpoint.
+type retryingDataBagsService struct {
+	ChefDataBagsService
+	*retrier
+}
+
+func (s retryingDataBagsService) ListItems(
+	databagName string) (items *chef.DataBagListResult, err error) {
+	err = s.do(func() error {
+		items, err = s.ChefDataBagsService.ListItems(databagName)
+		return err
+	})
+
+	return items, err
+}
+
+func (s retryingDataBagsService) GetItem(
+	databagName, databagItem string) (item chef.DataBagItem, err error) {
+	err = s.do(func() error {
+		item, err = s.ChefDataBagsService.GetItem(databagName, databagItem)
+		return err
+	})
+
+	return item, err
+}
+
+func (s retryingDataBagsService) CreateItem(
+	databagName string, databagItem chef.DataBagItem) error {
+	return s.do(func() error {
+		return s.ChefDataBagsService.CreateItem(databagName, databagItem)
+	})
+}
+
+func (s retryingDataBagsService) UpdateItem(databagName, databagItemID string,
+	databagItem chef.DataBagItem) error {
+	return s.do(func() error {
+		return s.ChefDataBagsService.UpdateItem(databagName, databagItemID, databagItem)
+	})
+}
+
+// retryingSearchService retries the failed requests to the search endpoint.
+type retryingSearchService struct {
+	ChefSearchService
+	*retrier
+}
+
+func (s retryingSearchService) Exec(idx, statement string,
+	start, rows int) (result chef.SearchResult, err error) {
+	err = s.do(func() error {
+		result, err = s.ChefSearchService.Exec(idx, statement, start, rows)
+		return err
+	})
+
+	return result, err
+}
+
+func (s retryingSearchService) PartialExec(idx, statement string, start, rows int,
+	params map[string]interface{}) (result chef.SearchResult, err error) {
+	err = s.do(func() error {
+		result, err = s.ChefSearchService.PartialExec(idx, statement, start, rows, params)
+		return err
+	})
+
+	return result, err
+}
@@ -0,0 +1,205 @@
+// Service for allowing new sensors to send flow based on a serial number.
+// Copyright (C) 2017 ENEO Tecnologia SL
+// Author: Diego Fernández Barrear <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package updater
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-chef/chef"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+var errRefused = &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+
+func testRetrier(config RetryConfig) (*retrier, *time.Time, *[]time.Duration) {
+	now := time.Unix(1500000000, 0)
+	var sleeps []time.Duration
+
+	r := newRetrier(config)
+	r.breaker.now = func() time.Time { return now }
+	r.sleep = func(d time.Duration) {
+		sleeps = append(sleeps, d)
+		now = now.Add(d)
+	}
+
+	return r, &now, &sleeps
+}
+
+func TestRetryBackoff(t *testing.T) {
+	r, _, sleeps := testRetrier(RetryConfig{
+		MaxRetries:     4,
+		InitialBackoff: time.Second,
+		MaxBackoff:     3 * time.Second,
+	})
+
+	attempts := 0
+	err := r.do(func() error {
+		attempts++
+		if attempts < 4 {
+			return errRefused
+		}
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 4, attempts)
+	assert.Equal(t,
+		[]time.Duration{time.Second, 2 * time.Second, 3 * time.Second}, *sleeps)
+}
+
+func TestRetryNotRetryable(t *testing.T) {
+	r, _, _ := testRetrier(RetryConfig{})
+
+	attempts := 0
+	err := r.do(func() error {
+		attempts++
+		return &chef.ErrorResponse{
+			Response: &http.Response{StatusCode: http.StatusNotFound},
+		}
+	})
+
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestRetryDisabled(t *testing.T) {
+	for _, config := range []RetryConfig{{MaxRetries: -1}, {Budget: -1}} {
+		r, _, sleeps := testRetrier(config)
+
+		attempts := 0
+		err := r.do(func() error {
+			attempts++
+			return errRefused
+		})
+
+		assert.Error(t, err)
+		assert.Equal(t, 1, attempts)
+		assert.Empty(t, *sleeps)
+	}
+}
+
+func TestRetryWithoutRetries(t *testing.T) {
+	r, _, sleeps := testRetrier(RetryConfig{BreakerThreshold: 2})
+	single := r.withoutRetries()
+
+	attempts := 0
+	failing := func() error {
+		attempts++
+		return errRefused
+	}
+
+	assert.Error(t, single.do(failing))
+	assert.Error(t, single.do(failing))
+	assert.Equal(t, 2, attempts)
+	assert.Empty(t, *sleeps)
+
+	// The circuit breaker is shared
+	assert.Equal(t, ErrCircuitOpen, r.do(failing))
+	assert.Equal(t, 2, attempts)
+}
+
+func TestIsRetryable(t *testing.T) {
+	status := func(code int) error {
+		return &chef.ErrorResponse{Response: &http.Response{StatusCode: code}}
+	}
+
+	for _, tc := range []struct {
+		err       error
+		retryable bool
+	}{
+		{nil, false},
+		{ErrCircuitOpen, false},
+		{errRefused, true},
+		{&url.Error{Op: "Get", URL: "https://chef", Err: errRefused}, true},
+		{&net.DNSError{Err: "timeout", IsTimeout: true}, true},
+		{status(http.StatusBadGateway), true},
+		{status(http.StatusTooManyRequests), true},
+		{status(http.StatusNotFound), false},
+		{&chef.ErrorResponse{}, false},
+		{&json.SyntaxError{}, false},
+		{&url.Error{Op: "Get", URL: "https://chef", Err: errors.New("bad certificate")}, false},
+		{errors.New("Invalid node"), false},
+	} {
+		assert.Equal(t, tc.retryable, isRetryable(tc.err), "%v", tc.err)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	r, _, _ := testRetrier(RetryConfig{
+		MaxRetries:       10,
+		Budget:           3,
+		BreakerThreshold: 100,
+	})
+
+	attempts := 0
+	err := r.do(func() error {
+		attempts++
+		return errRefused
+	})
+
+	assert.Error(t, err)
+	assert.Equal(t, 4, attempts)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	r, now, _ := testRetrier(RetryConfig{
+		MaxRetries:       1,
+		BreakerThreshold: 2,
+		BreakerCooldown:  time.Minute,
+	})
+
+	failing := func() error { return errRefused }
+
+	assert.Error(t, r.do(failing))
+
+	attempts := 0
+	err := r.do(func() error {
+		attempts++
+		return nil
+	})
+	assert.Equal(t, ErrCircuitOpen, err)
+	assert.Equal(t, 0, attempts)
+
+	*now = now.Add(time.Minute)
+	assert.NoError(t, r.do(func() error { return nil }))
+	assert.NoError(t, r.breaker.allow())
+}
+
+func TestRetryingNodesService(t *testing.T) {
+	nodesAPI := new(ChefNodesMock)
+	nodesAPI.On("Put", mock.AnythingOfType("chef.Node")).Return(chef.Node{},
+		&chef.ErrorResponse{
+			Response: &http.Response{StatusCode: http.StatusBadGateway},
+		}).Once()
+	nodesAPI.On("Put", mock.AnythingOfType("chef.Node")).Return(chef.Node{}, nil)
+
+	r, _, _ := testRetrier(RetryConfig{})
+	service := retryingNodesService{nodesAPI, r}
+
+	_, err := service.Put(chef.Node{Name: "sensor-a"})
+	assert.NoError(t, err)
+	nodesAPI.AssertNumberOfCalls(t, "Put", 2)
+}
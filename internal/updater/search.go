@@ -0,0 +1,78 @@
+// Service for allowing new sensors to send flow based on a serial number.
+// Copyright (C) 2017 ENEO Tecnologia SL
+// Author: Diego Fernández Barrear <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package updater
+
+import (
+	"net/url"
+	"strconv"
+
+	"github.com/go-chef/chef"
+)
+
+// searchPageSize is the number of rows requested on each page of a search.
+// It's the default of the Chef server.
+const searchPageSize = 1000
+
+// searchSort is the order of the search results. A stable order is required
+// to page through them.
+const searchSort = "X_CHEF_id_CHEF_X asc"
+
+// searchService sends requests for a single page of results to the search
+// endpoint of the Chef API.
+type searchService struct {
+	client *chef.Client
+}
+
+func (s searchService) Exec(idx, statement string,
+	start, rows int) (result chef.SearchResult, err error) {
+	req, err := s.client.NewRequest("GET", searchURL(idx, statement, start, rows), nil)
+	if err != nil {
+		return result, err
+	}
+
+	_, err = s.client.Do(req, &result)
+	return result, err
+}
+
+func (s searchService) PartialExec(idx, statement string, start, rows int,
+	params map[string]interface{}) (result chef.SearchResult, err error) {
+	body, err := chef.JSONReader(params)
+	if err != nil {
+		return result, err
+	}
+
+	req, err := s.client.NewRequest("POST", searchURL(idx, statement, start, rows), body)
+	if err != nil {
+		return result, err
+	}
+
+	_, err = s.client.Do(req, &result)
+	return result, err
+}
+
+// searchURL returns the URL of a page of search results, relative to the Chef
+// server URL.
+func searchURL(idx, statement string, start, rows int) string {
+	query := url.Values{}
+	query.Set("q", statement)
+	query.Set("sort", searchSort)
+	query.Set("start", strconv.Itoa(start))
+	query.Set("rows", strconv.Itoa(rows))
+
+	return "search/" + idx + "?" + query.Encode()
+}
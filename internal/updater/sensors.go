@@ -0,0 +1,223 @@
+// Service for allowing new sensors to send flow based on a serial number.
+// Copyright (C) 2017 ENEO Tecnologia SL
+// Author: Diego Fernández Barrera <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package updater
+
+import (
+	"sync"
+
+	"github.com/go-chef/chef"
+)
+
+// sensor is the Chef node of a sensor. The lock must be held while the node
+// attributes are read or modified, including while the node is sent to Chef.
+type sensor struct {
+	sync.Mutex
+	*chef.Node
+
+	uuid string
+	name string
+
+	// keys contains the indexed values of the node. Guarded by the
+	// sensorsDB lock.
+	keys map[string]string
+}
+
+// sensorsIndex maps an attribute value to the sensors having that value.
+type sensorsIndex map[string][]*sensor
+
+// sensorsDB is a concurrency safe store of sensors indexed by sensor UUID.
+// The whole set of sensors is replaced at once when the nodes are fetched, so
+// readers always see a consistent snapshot.
+//
+// Secondary indexes are kept for the attribute paths given on creation (e.g.
+// serial number or organization UUID). Locks must be acquired in the order
+// sensor, sensorsDB.
+type sensorsDB struct {
+	mu      sync.RWMutex
+	sensors map[string]*sensor
+	names   map[string]*sensor
+	paths   []string
+	indexes map[string]sensorsIndex
+}
+
+// newSensorsDB creates a sensors store with the given nodes, indexed by sensor
+// UUID and by the values of the attributes on the given paths.
+func newSensorsDB(nodes map[string]*chef.Node, paths ...string) *sensorsDB {
+	db := &sensorsDB{paths: paths}
+	db.swap(nodes)
+
+	return db
+}
+
+// swap replaces the stored sensors with the given nodes and rebuilds the
+// indexes. The nodes must not be modified by the caller afterwards. The
+// replaced sensors are returned.
+func (db *sensorsDB) swap(nodes map[string]*chef.Node) []*sensor {
+	sensors := make(map[string]*sensor, len(nodes))
+	names := make(map[string]*sensor, len(nodes))
+	indexes := make(map[string]sensorsIndex, len(db.paths))
+	for _, path := range db.paths {
+		indexes[path] = make(sensorsIndex)
+	}
+
+	for uuid, node := range nodes {
+		s := &sensor{Node: node, uuid: uuid, name: node.Name}
+		sensors[uuid] = s
+		names[s.name] = s
+		addToIndexes(indexes, db.paths, s)
+	}
+
+	db.mu.Lock()
+	previous := make([]*sensor, 0, len(db.sensors))
+	for _, s := range db.sensors {
+		previous = append(previous, s)
+	}
+
+	db.sensors = sensors
+	db.names = names
+	db.indexes = indexes
+	db.mu.Unlock()
+
+	return previous
+}
+
+// remove deletes a sensor from the store, e.g. when the node doesn't exist on
+// Chef anymore. The sensor lock must be held by the caller.
+func (db *sensorsDB) remove(s *sensor) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.sensors[s.uuid] != s {
+		return
+	}
+
+	delete(db.sensors, s.uuid)
+	delete(db.names, s.name)
+	removeFromIndexes(db.indexes, s)
+}
+
+// exists checks if there is a sensor stored for the node of the given sensor.
+// The sensor may belong to a previous snapshot.
+func (db *sensorsDB) exists(s *sensor) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	_, ok := db.names[s.name]
+	return ok
+}
+
+// reindex updates the indexes after the attributes of a sensor have changed.
+// Sensors that have been replaced by a newer snapshot are ignored. The sensor
+// lock must be held by the caller.
+func (db *sensorsDB) reindex(s *sensor) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.sensors[s.uuid] != s {
+		return
+	}
+
+	removeFromIndexes(db.indexes, s)
+	addToIndexes(db.indexes, db.paths, s)
+}
+
+// get returns the sensor with the given UUID or nil if it doesn't exist.
+func (db *sensorsDB) get(uuid string) *sensor {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.sensors[uuid]
+}
+
+// all returns every stored sensor.
+func (db *sensorsDB) all() []*sensor {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	sensors := make([]*sensor, 0, len(db.sensors))
+	for _, s := range db.sensors {
+		sensors = append(sensors, s)
+	}
+
+	return sensors
+}
+
+// find returns the sensors whose attribute on the given path has the given
+// value. The second value is false if there is no index for the path.
+func (db *sensorsDB) find(path, value string) ([]*sensor, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	index, ok := db.indexes[path]
+	if !ok {
+		return nil, false
+	}
+
+	sensors := make([]*sensor, len(index[value]))
+	copy(sensors, index[value])
+
+	return sensors, true
+}
+
+func addToIndexes(indexes map[string]sensorsIndex, paths []string, s *sensor) {
+	s.keys = make(map[string]string, len(paths))
+
+	for _, path := range paths {
+		value, ok := getString(s.NormalAttributes, path)
+		if !ok {
+			continue
+		}
+
+		s.keys[path] = value
+		indexes[path][value] = append(indexes[path][value], s)
+	}
+}
+
+func removeFromIndexes(indexes map[string]sensorsIndex, s *sensor) {
+	for path, value := range s.keys {
+		index, ok := indexes[path]
+		if !ok {
+			continue
+		}
+
+		sensors := index[value]
+		for i, other := range sensors {
+			if other == s {
+				sensors = append(sensors[:i:i], sensors[i+1:]...)
+				break
+			}
+		}
+
+		if len(sensors) == 0 {
+			delete(index, value)
+		} else {
+			index[value] = sensors
+		}
+	}
+}
+
+// getString returns the string value of an attribute given its path.
+func getString(root map[string]interface{}, path string) (string, bool) {
+	attributes, err := getParent(root, path)
+	if err != nil {
+		return "", false
+	}
+
+	value, ok := attributes[getKeyFromPath(path)].(string)
+	return value, ok
+}
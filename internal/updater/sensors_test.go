@@ -0,0 +1,75 @@
+// Service for allowing new sensors to send flow based on a serial number.
+// Copyright (C) 2017 ENEO Tecnologia SL
+// Author: Diego Fernández Barrera <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package updater
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSensorsDBIndexes(t *testing.T) {
+	nodes := bootstrapSensorsDB()
+	db := newSensorsDB(nodes,
+		"org/serial_number", "org/organization_uuid", "org/license_uuid")
+
+	found, ok := db.find("org/serial_number", "888888")
+	assert.True(t, ok)
+	if assert.Len(t, found, 1) {
+		assert.Equal(t, nodes["0"], found[0].Node)
+	}
+
+	found, ok = db.find("org/license_uuid", "0000000000")
+	assert.True(t, ok)
+	assert.Len(t, found, 1)
+
+	found, ok = db.find("org/organization_uuid", "unknown")
+	assert.True(t, ok)
+	assert.Empty(t, found)
+
+	_, ok = db.find("org2/serial_number", "777777")
+	assert.False(t, ok)
+}
+
+func TestSensorsDBReindex(t *testing.T) {
+	nodes := bootstrapSensorsDB()
+	db := newSensorsDB(nodes, "org/license_uuid")
+
+	s := db.get("2")
+	s.Lock()
+	s.NormalAttributes["org"].(map[string]interface{})["license_uuid"] = "0000000000"
+	db.reindex(s)
+	s.Unlock()
+
+	found, _ := db.find("org/license_uuid", "0000000000")
+	assert.Len(t, found, 2)
+	found, _ = db.find("org/license_uuid", "1111111111")
+	assert.Empty(t, found)
+
+	db.swap(bootstrapSensorsDB())
+
+	s.Lock()
+	s.NormalAttributes["org"].(map[string]interface{})["license_uuid"] = "2222222222"
+	db.reindex(s)
+	s.Unlock()
+
+	found, _ = db.find("org/license_uuid", "2222222222")
+	assert.Empty(t, found)
+	found, _ = db.find("org/license_uuid", "1111111111")
+	assert.Len(t, found, 1)
+}
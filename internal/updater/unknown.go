@@ -0,0 +1,509 @@
+// Service for allowing new sensors to send flow based on a serial number.
+// Copyright (C) 2017 ENEO Tecnologia SL
+// Author: Diego Fernández Barrear <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package updater
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chef/chef"
+)
+
+// maxUnknownSensors is the maximum number of unknown serial numbers kept. When
+// the registry is full the serial number seen least recently is discarded, so
+// packets with random serial numbers can't exhaust the memory.
+const maxUnknownSensors = 10000
+
+// defaultUnknownSensorTTL is the time an unknown serial number is kept since
+// it was last seen when ProvisioningConfig.TTL is not set.
+const defaultUnknownSensorTTL = 24 * time.Hour
+
+// defaultProvisioningRate is the number of Chef objects created per minute
+// when ProvisioningConfig.Rate is not set.
+const defaultProvisioningRate = 10
+
+// Provisioning modes for the unknown serial numbers.
+const (
+	ProvisionNode    = "node"     // Create a blocked Chef node
+	ProvisionDataBag = "data_bag" // Create a data bag item
+)
+
+// Status of the items on the provisioning data bag.
+const (
+	pendingStatus  = "pending"
+	approvedStatus = "approved"
+)
+
+// ProvisioningConfig configures how the serial numbers that don't belong to
+// any sensor are provisioned. They are only kept in memory if Mode is empty.
+// Otherwise they are provisioned once they are confirmed by the
+// AddressConfirmation policy, up to Rate per minute.
+type ProvisioningConfig struct {
+	Mode        string
+	NodePrefix  string        // Prefix of the name of the created nodes
+	DataBagName string        // Data bag where the items are created
+	TTL         time.Duration // Time unknown serial numbers are kept since last seen
+	Rate        int           // Chef objects created per minute
+}
+
+func (c ProvisioningConfig) validate() error {
+	switch c.Mode {
+	case "", ProvisionNode:
+	case ProvisionDataBag:
+		if len(c.DataBagName) == 0 {
+			return errors.New("Invalid provisioning: No data bag name")
+		}
+	default:
+		return fmt.Errorf("Invalid provisioning mode %q", c.Mode)
+	}
+
+	return nil
+}
+
+func (c ProvisioningConfig) ttl() time.Duration {
+	if c.TTL > 0 {
+		return c.TTL
+	}
+
+	return defaultUnknownSensorTTL
+}
+
+func (c ProvisioningConfig) rate() int {
+	if c.Rate > 0 {
+		return c.Rate
+	}
+
+	return defaultProvisioningRate
+}
+
+// UnknownSensor is a serial number that doesn't belong to any sensor, waiting
+// to be approved.
+type UnknownSensor struct {
+	SerialNumber  string
+	Address       string // Last address
+	ObservationID uint32 // Last Observation Domain ID
+	ProductType   uint32 // Last Product Type
+	FirstSeen     time.Time
+	LastSeen      time.Time
+	Sightings     int
+	Provisioned   bool // Created on Chef
+}
+
+// UnknownSensorError is returned when the serial number on the flow doesn't
+// belong to any sensor.
+type UnknownSensorError struct {
+	UnknownSensor
+}
+
+func (e *UnknownSensorError) Error() string {
+	return "Node not found: Unknown serial number " + e.SerialNumber
+}
+
+// unknownSensors is the registry of unknown serial numbers.
+type unknownSensors struct {
+	mu          sync.Mutex
+	sensors     map[string]*UnknownSensor
+	budget      int // Provisions left until budgetReset
+	budgetReset time.Time
+	applied     map[string]bool // Data bag items already approved
+}
+
+// observe records a sighting of an unknown serial number.
+func (u *unknownSensors) observe(serialNumber, address string,
+	obsID, productType uint32, now time.Time) UnknownSensor {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.sensors == nil {
+		u.sensors = make(map[string]*UnknownSensor)
+	}
+
+	sensor, ok := u.sensors[serialNumber]
+	if !ok {
+		if len(u.sensors) >= maxUnknownSensors {
+			u.evictOldest()
+		}
+
+		sensor = &UnknownSensor{SerialNumber: serialNumber, FirstSeen: now}
+		u.sensors[serialNumber] = sensor
+	}
+
+	sensor.Address = address
+	sensor.ObservationID = obsID
+	sensor.ProductType = productType
+	sensor.LastSeen = now
+	sensor.Sightings++
+
+	return *sensor
+}
+
+// evictOldest discards the serial number seen least recently. The lock must be
+// held by the caller.
+func (u *unknownSensors) evictOldest() {
+	var oldest *UnknownSensor
+
+	for _, sensor := range u.sensors {
+		if oldest == nil || sensor.LastSeen.Before(oldest.LastSeen) {
+			oldest = sensor
+		}
+	}
+
+	if oldest != nil {
+		delete(u.sensors, oldest.SerialNumber)
+	}
+}
+
+// expire discards the serial numbers not seen since the given time.
+func (u *unknownSensors) expire(before time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for serialNumber, sensor := range u.sensors {
+		if sensor.LastSeen.Before(before) {
+			delete(u.sensors, serialNumber)
+		}
+	}
+}
+
+// takeProvision consumes a provision from the budget. Returns false if there
+// are no provisions left for the current minute.
+func (u *unknownSensors) takeProvision(rate int, now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if now.After(u.budgetReset) {
+		u.budget = rate
+		u.budgetReset = now.Add(time.Minute)
+	}
+
+	if u.budget == 0 {
+		return false
+	}
+
+	u.budget--
+	return true
+}
+
+// provisioned marks a serial number as created on Chef.
+func (u *unknownSensors) provisioned(serialNumber string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if sensor, ok := u.sensors[serialNumber]; ok {
+		sensor.Provisioned = true
+	}
+}
+
+// isApplied returns true if the data bag item has been approved already.
+func (u *unknownSensors) isApplied(id string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.applied[id]
+}
+
+// apply records that a data bag item has been approved, so it's not read
+// again.
+func (u *unknownSensors) apply(id string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.applied == nil {
+		u.applied = make(map[string]bool)
+	}
+	u.applied[id] = true
+}
+
+// retainApplied forgets the approved items no longer on the data bag.
+func (u *unknownSensors) retainApplied(ids map[string]string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for id := range u.applied {
+		if _, ok := ids[id]; !ok {
+			delete(u.applied, id)
+		}
+	}
+}
+
+// forget removes the serial numbers that belong to a sensor now.
+func (u *unknownSensors) forget(known func(serialNumber string) bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for serialNumber := range u.sensors {
+		if known(serialNumber) {
+			delete(u.sensors, serialNumber)
+		}
+	}
+}
+
+// list returns the unknown serial numbers sorted by serial number.
+func (u *unknownSensors) list() []UnknownSensor {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	serialNumbers := make([]string, 0, len(u.sensors))
+	for serialNumber := range u.sensors {
+		serialNumbers = append(serialNumbers, serialNumber)
+	}
+	sort.Strings(serialNumbers)
+
+	sensors := make([]UnknownSensor, 0, len(serialNumbers))
+	for _, serialNumber := range serialNumbers {
+		sensors = append(sensors, *u.sensors[serialNumber])
+	}
+
+	return sensors
+}
+
+// handleUnknownSensor records a serial number that doesn't belong to any
+// sensor and provisions it on Chef if it wasn't already.
+//
+// Serial numbers are provisioned only after the sightings required to change
+// the address of a sensor, so a single spoofed packet can't create objects on
+// Chef, and only up to the provisioning rate.
+func (cu *ChefUpdater) handleUnknownSensor(address string, serialNumber string,
+	obsID uint32, productType uint32) error {
+	now := time.Now()
+	sensor := cu.unknown.observe(serialNumber, address, obsID, productType, now)
+
+	if len(cu.Provisioning.Mode) == 0 || sensor.Provisioned {
+		return &UnknownSensorError{sensor}
+	}
+
+	if cu.unknownConfirmer == nil ||
+		cu.unknownConfirmer.confirm(serialNumber, "", address, now) != nil {
+		return &UnknownSensorError{sensor}
+	}
+	if !cu.unknown.takeProvision(cu.Provisioning.rate(), now) {
+		log.Warnf("Unknown sensor %s not provisioned: Provisioning rate exceeded",
+			serialNumber)
+		return &UnknownSensorError{sensor}
+	}
+
+	var err error
+	switch cu.Provisioning.Mode {
+	case ProvisionNode:
+		err = cu.provisionNode(sensor)
+	case ProvisionDataBag:
+		err = cu.provisionDataBagItem(sensor)
+	}
+	if err != nil && !isConflict(err) {
+		return errors.New("Error provisioning " + serialNumber + ": " + err.Error())
+	}
+
+	log.Infof("Unknown sensor %s provisioned for approval [%s]",
+		serialNumber, cu.Provisioning.Mode)
+	cu.unknown.provisioned(serialNumber)
+	sensor.Provisioned = true
+
+	return &UnknownSensorError{sensor}
+}
+
+// provisionNode creates a blocked node for an unknown serial number. The node
+// has no sensor UUID, so it's not used until an operator approves it by
+// setting the sensor and organization UUIDs and unblocking it.
+func (cu *ChefUpdater) provisionNode(sensor UnknownSensor) error {
+	return cu.postNode(cu.Provisioning.NodePrefix+sensor.SerialNumber,
+		map[string]interface{}{
+			cu.SerialNumberPath:  sensor.SerialNumber,
+			cu.IPAddressPath:     sensor.Address,
+			cu.ObservationIDPath: strconv.FormatUint(uint64(sensor.ObservationID), 10),
+			cu.ProductTypePath:   strconv.FormatUint(uint64(sensor.ProductType), 10),
+			cu.BlockedStatusPath: true,
+		}, TriggerProvisioning)
+}
+
+// postNode creates a node with the given attributes. Attributes without a
+// path configured are skipped. On dry run the node is only logged.
+//
+// The attributes of the new node are recorded on the audit trail.
+func (cu *ChefUpdater) postNode(name string, attributes map[string]interface{},
+	trigger string) error {
+	node := chef.NewNode(name)
+	node.NormalAttributes = make(map[string]interface{})
+	values := make(map[string]interface{})
+
+	for path, value := range attributes {
+		if len(path) > 0 {
+			setAttribute(node.NormalAttributes, path, value)
+			values[path] = value
+		}
+	}
+	changes := newChanges(values, trigger)
+
+	if cu.DryRun {
+		log.Infof("Dry run: node %s not created", name)
+		logDiff(name, nil, changes)
+		return nil
+	}
+
+	if _, err := cu.client.Post(node); err != nil {
+		return err
+	}
+
+	cu.audit(name, nil, changes)
+	return nil
+}
+
+// provisionDataBagItem creates a pending data bag item for an unknown serial
+// number. On dry run the item is only logged.
+func (cu *ChefUpdater) provisionDataBagItem(sensor UnknownSensor) error {
+	item := map[string]interface{}{
+		"id":             sensor.SerialNumber,
+		"status":         pendingStatus,
+		"serial_number":  sensor.SerialNumber,
+		"ipaddress":      sensor.Address,
+		"observation_id": strconv.FormatUint(uint64(sensor.ObservationID), 10),
+		"product_type":   strconv.FormatUint(uint64(sensor.ProductType), 10),
+		"first_seen":     sensor.FirstSeen.UTC().Format(time.RFC3339),
+	}
+
+	if cu.DryRun {
+		log.WithFields(item).Infof("Dry run: item %s not created on data bag %s",
+			sensor.SerialNumber, cu.Provisioning.DataBagName)
+		return nil
+	}
+
+	return cu.dataBags.CreateItem(cu.Provisioning.DataBagName, item)
+}
+
+// approveSensors creates a node for every pending item of the provisioning
+// data bag approved by an operator, i.e. with the sensor and organization
+// UUIDs set. New nodes are blocked until their license is allowed. If the node
+// already exists these attributes are updated instead, keeping its blocked
+// status. The item is then marked as approved, so it's not applied again.
+// Errors are added to the summary.
+func (cu *ChefUpdater) approveSensors(summary *FetchSummary) {
+	items, err := cu.dataBags.ListItems(cu.Provisioning.DataBagName)
+	if err != nil {
+		summary.Errors = append(summary.Errors,
+			errors.New("Couldn't list pending sensors: "+err.Error()))
+		return
+	}
+	if items == nil {
+		return
+	}
+	cu.unknown.retainApplied(*items)
+
+	ids := make([]string, 0, len(*items))
+	for id := range *items {
+		if !cu.unknown.isApplied(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		approved, err := cu.approveSensor(id)
+		if err != nil {
+			summary.Errors = append(summary.Errors,
+				errors.New("Error approving sensor "+id+": "+err.Error()))
+		} else if approved {
+			summary.Approved++
+		}
+	}
+}
+
+// approveSensor applies an item of the provisioning data bag. Returns false if
+// the item is not approved yet. Items already approved are not read again on
+// the next fetches.
+func (cu *ChefUpdater) approveSensor(id string) (bool, error) {
+	raw, err := cu.dataBags.GetItem(cu.Provisioning.DataBagName, id)
+	if err != nil {
+		return false, err
+	}
+
+	item, ok := raw.(map[string]interface{})
+	if !ok {
+		return false, fmt.Errorf("Invalid item: Expected an object but got %T", raw)
+	}
+
+	status, _ := item["status"].(string)
+	serialNumber, _ := item["serial_number"].(string)
+	sensorUUID, _ := item["sensor_uuid"].(string)
+	organizationUUID, _ := item["organization_uuid"].(string)
+
+	if status == approvedStatus {
+		cu.unknown.apply(id)
+		return false, nil
+	}
+	if status != pendingStatus || len(sensorUUID) == 0 || len(organizationUUID) == 0 {
+		return false, nil
+	}
+	if len(serialNumber) == 0 {
+		return false, errors.New("Invalid item: No serial number")
+	}
+
+	name := cu.Provisioning.NodePrefix + serialNumber
+	attributes := map[string]interface{}{
+		cu.SerialNumberPath:     serialNumber,
+		cu.SensorUUIDPath:       sensorUUID,
+		cu.OrganizationUUIDPath: organizationUUID,
+	}
+	for path, key := range map[string]string{
+		cu.IPAddressPath:     "ipaddress",
+		cu.ObservationIDPath: "observation_id",
+		cu.ProductTypePath:   "product_type",
+	} {
+		if value, ok := item[key].(string); ok {
+			attributes[path] = value
+		}
+	}
+
+	blocked := map[string]interface{}{cu.BlockedStatusPath: true}
+	for path, value := range attributes {
+		blocked[path] = value
+	}
+
+	err = cu.postNode(name, blocked, TriggerApproval)
+	if isConflict(err) {
+		values := make(map[string]interface{})
+		for path, value := range attributes {
+			if len(path) > 0 {
+				values[path] = value
+			}
+		}
+
+		cu.writeMu.Lock()
+		_, _, err = cu.writeNode(name, newChanges(values, TriggerApproval))
+		cu.writeMu.Unlock()
+	}
+	if err != nil {
+		return false, err
+	}
+	if cu.DryRun {
+		log.Infof("Dry run: sensor %s not approved", serialNumber)
+		return false, nil
+	}
+
+	item["status"] = approvedStatus
+	if err := cu.dataBags.UpdateItem(cu.Provisioning.DataBagName, id, item); err != nil {
+		return false, err
+	}
+	cu.unknown.apply(id)
+
+	log.Infof("Sensor %s approved: Node %s has UUID %s",
+		serialNumber, name, sensorUUID)
+	return true, nil
+}
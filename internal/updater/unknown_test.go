@@ -0,0 +1,366 @@
+// Service for allowing new sensors to send flow based on a serial number.
+// Copyright (C) 2017 ENEO Tecnologia SL
+// Author: Diego Fernández Barrear <bigomby@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package updater
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-chef/chef"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func unknownSensorsUpdater(provisioning ProvisioningConfig) *ChefUpdater {
+	return &ChefUpdater{
+		nodes:            newSensorsDB(nil),
+		unknownConfirmer: newAddressConfirmer(AddressConfirmation{Sightings: 2}),
+		ChefUpdaterConfig: ChefUpdaterConfig{
+			SensorUUIDPath:    "org/uuid",
+			SerialNumberPath:  "org/serial_number",
+			BlockedStatusPath: "org/blocked",
+			IPAddressPath:     "org/ipaddress",
+			ObservationIDPath: "org/observation_id",
+			ProductTypePath:   "org/product_type",
+			Provisioning:      provisioning,
+		},
+	}
+}
+
+// fetchNodes refreshes the sensors database of the updater with the given
+// nodes.
+func fetchNodes(t *testing.T, chefUpdater *ChefUpdater, nodes ...chef.Node) {
+	nodesAPI := new(ChefNodesMock)
+	dataBagsAPI := new(ChefDataBagsMock)
+
+	names := make(map[string]string)
+	for _, node := range nodes {
+		names[node.Name] = ""
+		nodesAPI.On("Get", node.Name).Return(node, nil)
+	}
+	nodesAPI.On("List").Return(names, nil)
+	dataBagsAPI.On("GetItem", "rBglobal", "licenses").Return(
+		map[string]interface{}{"sensors": map[string]interface{}{}}, nil)
+
+	client, dataBags := chefUpdater.client, chefUpdater.dataBags
+	chefUpdater.client, chefUpdater.dataBags = nodesAPI, dataBagsAPI
+	chefUpdater.DataBagName, chefUpdater.DataBagItem = "rBglobal", "licenses"
+
+	_, err := chefUpdater.FetchNodes()
+	assert.NoError(t, err)
+
+	chefUpdater.client, chefUpdater.dataBags = client, dataBags
+}
+
+func TestUnknownSensors(t *testing.T) {
+	chefUpdater := unknownSensorsUpdater(ProvisioningConfig{})
+
+	err := chefUpdater.UpdateNode(net.ParseIP("10.0.0.1"), "111111", 10, 999)
+	assert.IsType(t, &UnknownSensorError{}, err)
+	err = chefUpdater.UpdateNode(net.ParseIP("10.0.0.2"), "111111", 11, 999)
+	if assert.IsType(t, &UnknownSensorError{}, err) {
+		assert.Equal(t, 2, err.(*UnknownSensorError).Sightings)
+	}
+
+	unknown := chefUpdater.UnknownSensors()
+	if assert.Len(t, unknown, 1) {
+		assert.Equal(t, "111111", unknown[0].SerialNumber)
+		assert.Equal(t, "10.0.0.2", unknown[0].Address)
+		assert.Equal(t, uint32(11), unknown[0].ObservationID)
+		assert.Equal(t, uint32(999), unknown[0].ProductType)
+		assert.False(t, unknown[0].Provisioned)
+		assert.False(t, unknown[0].LastSeen.Before(unknown[0].FirstSeen))
+	}
+
+	// Approved and fetched
+	fetchNodes(t, chefUpdater, sensorNode("sensor-a", "aaaa", "111111"))
+	assert.Empty(t, chefUpdater.UnknownSensors())
+}
+
+func TestUnknownSensorsLimit(t *testing.T) {
+	u := &unknownSensors{}
+	now := time.Now()
+
+	for i := 0; i < maxUnknownSensors; i++ {
+		u.observe(string(rune(i)), "10.0.0.1", 0, 0, now.Add(time.Duration(i)))
+	}
+	u.observe(string(rune(0)), "10.0.0.1", 0, 0, now.Add(maxUnknownSensors))
+
+	// The serial number seen least recently is discarded
+	u.observe("full", "10.0.0.1", 0, 0, now.Add(maxUnknownSensors))
+	assert.Len(t, u.sensors, maxUnknownSensors)
+	assert.Contains(t, u.sensors, "full")
+	assert.Contains(t, u.sensors, string(rune(0)))
+	assert.NotContains(t, u.sensors, string(rune(1)))
+}
+
+func TestUnknownSensorsExpire(t *testing.T) {
+	chefUpdater := unknownSensorsUpdater(ProvisioningConfig{TTL: time.Hour})
+	now := time.Now()
+
+	chefUpdater.unknown.observe("111111", "10.0.0.1", 10, 999, now.Add(-2*time.Hour))
+	chefUpdater.unknown.observe("222222", "10.0.0.2", 10, 999, now)
+
+	fetchNodes(t, chefUpdater)
+
+	unknown := chefUpdater.UnknownSensors()
+	if assert.Len(t, unknown, 1) {
+		assert.Equal(t, "222222", unknown[0].SerialNumber)
+	}
+}
+
+func TestProvisionNode(t *testing.T) {
+	nodesAPI := new(ChefNodesMock)
+	nodesAPI.On("Post", mock.AnythingOfType("chef.Node")).
+		Return(&chef.NodeResult{}, nil).Once()
+
+	chefUpdater := unknownSensorsUpdater(ProvisioningConfig{
+		Mode:       ProvisionNode,
+		NodePrefix: "sensor-",
+	})
+	chefUpdater.client = nodesAPI
+	auditor := &auditRecorder{}
+	chefUpdater.Auditor = auditor
+
+	// Not created until confirmed
+	err := chefUpdater.UpdateNode(net.ParseIP("10.0.0.1"), "111111", 10, 999)
+	if assert.IsType(t, &UnknownSensorError{}, err) {
+		assert.False(t, err.(*UnknownSensorError).Provisioned)
+	}
+	nodesAPI.AssertNotCalled(t, "Post", mock.Anything)
+
+	err = chefUpdater.UpdateNode(net.ParseIP("10.0.0.1"), "111111", 10, 999)
+	if assert.IsType(t, &UnknownSensorError{}, err) {
+		assert.True(t, err.(*UnknownSensorError).Provisioned)
+	}
+
+	// Only created once
+	err = chefUpdater.UpdateNode(net.ParseIP("10.0.0.1"), "111111", 10, 999)
+	assert.IsType(t, &UnknownSensorError{}, err)
+	nodesAPI.AssertNumberOfCalls(t, "Post", 1)
+
+	node := nodesAPI.Calls[0].Arguments.Get(0).(chef.Node)
+	assert.Equal(t, "sensor-111111", node.Name)
+
+	attrs, err := getParent(node.NormalAttributes, "org/serial_number")
+	assert.NoError(t, err)
+	assert.Equal(t, "111111", attrs["serial_number"])
+	assert.Equal(t, "10.0.0.1", attrs["ipaddress"])
+	assert.Equal(t, "10", attrs["observation_id"])
+	assert.Equal(t, "999", attrs["product_type"])
+	assert.Equal(t, true, attrs["blocked"])
+	assert.NotContains(t, attrs, "uuid")
+
+	if assert.NotEmpty(t, auditor.events) {
+		for _, event := range auditor.events {
+			assert.Equal(t, "sensor-111111", event.Node)
+			assert.Equal(t, TriggerProvisioning, event.Trigger)
+			assert.Nil(t, event.OldValue)
+		}
+	}
+}
+
+func TestProvisionNodeDryRun(t *testing.T) {
+	nodesAPI := new(ChefNodesMock)
+	dataBagsAPI := new(ChefDataBagsMock)
+
+	for _, mode := range []string{ProvisionNode, ProvisionDataBag} {
+		chefUpdater := unknownSensorsUpdater(ProvisioningConfig{
+			Mode:        mode,
+			NodePrefix:  "sensor-",
+			DataBagName: "sensors",
+		})
+		chefUpdater.client = nodesAPI
+		chefUpdater.dataBags = dataBagsAPI
+		chefUpdater.DryRun = true
+
+		for i := 0; i < 2; i++ {
+			chefUpdater.UpdateNode(net.ParseIP("10.0.0.1"), "111111", 10, 999)
+		}
+	}
+
+	nodesAPI.AssertNotCalled(t, "Post", mock.Anything)
+	dataBagsAPI.AssertNotCalled(t, "CreateItem", mock.Anything, mock.Anything)
+}
+
+func TestProvisionDataBagItem(t *testing.T) {
+	dataBagsAPI := new(ChefDataBagsMock)
+	dataBagsAPI.On("CreateItem", "pending_sensors", mock.Anything).
+		Return(errors.New("Chef down")).Once()
+	dataBagsAPI.On("CreateItem", "pending_sensors", mock.Anything).
+		Return(nil).Once()
+
+	chefUpdater := unknownSensorsUpdater(ProvisioningConfig{
+		Mode:        ProvisionDataBag,
+		DataBagName: "pending_sensors",
+	})
+	chefUpdater.dataBags = dataBagsAPI
+
+	// Retried once confirmed again
+	for i := 0; i < 4; i++ {
+		err := chefUpdater.UpdateNode(net.ParseIP("10.0.0.1"), "111111", 10, 999)
+		if i == 1 {
+			assert.Error(t, err)
+			assert.False(t, chefUpdater.UnknownSensors()[0].Provisioned)
+		} else {
+			assert.IsType(t, &UnknownSensorError{}, err)
+		}
+	}
+	assert.True(t, chefUpdater.UnknownSensors()[0].Provisioned)
+	dataBagsAPI.AssertNumberOfCalls(t, "CreateItem", 2)
+
+	item := dataBagsAPI.Calls[1].Arguments.Get(1).(map[string]interface{})
+	assert.Equal(t, "111111", item["id"])
+	assert.Equal(t, "pending", item["status"])
+	assert.Equal(t, "10.0.0.1", item["ipaddress"])
+	assert.Equal(t, "999", item["product_type"])
+}
+
+func TestApproveDataBagItems(t *testing.T) {
+	conflict := &chef.ErrorResponse{
+		Response: &http.Response{StatusCode: http.StatusConflict},
+	}
+	named := func(name string) interface{} {
+		return mock.MatchedBy(func(node chef.Node) bool { return node.Name == name })
+	}
+
+	nodesAPI := new(ChefNodesMock)
+	nodesAPI.On("List").Return(map[string]string{}, nil)
+	nodesAPI.On("Post", named("sensor-111111")).Return(&chef.NodeResult{}, nil).Once()
+	nodesAPI.On("Post", named("sensor-333333")).Return((*chef.NodeResult)(nil), conflict).Once()
+	nodesAPI.On("Get", "sensor-333333").Return(chef.Node{
+		Name: "sensor-333333",
+		NormalAttributes: map[string]interface{}{
+			"org": map[string]interface{}{"blocked": true},
+		},
+	}, nil).Once()
+	nodesAPI.On("Put", named("sensor-333333")).Return(chef.Node{}, nil).Once()
+
+	approved := func(serialNumber string) map[string]interface{} {
+		return map[string]interface{}{
+			"id":                serialNumber,
+			"status":            "pending",
+			"serial_number":     serialNumber,
+			"ipaddress":         "10.0.0.1",
+			"product_type":      "999",
+			"sensor_uuid":       "uuid-" + serialNumber,
+			"organization_uuid": "org",
+		}
+	}
+
+	dataBagsAPI := new(ChefDataBagsMock)
+	dataBagsAPI.On("GetItem", "rBglobal", "licenses").Return(
+		map[string]interface{}{"sensors": map[string]interface{}{}}, nil)
+	dataBagsAPI.On("ListItems", "pending_sensors").Return(&chef.DataBagListResult{
+		"111111": "", "222222": "", "333333": "", "444444": "",
+	}, nil)
+	dataBagsAPI.On("GetItem", "pending_sensors", "111111").Return(approved("111111"), nil)
+	dataBagsAPI.On("GetItem", "pending_sensors", "222222").Return(map[string]interface{}{
+		"id":            "222222",
+		"status":        "pending",
+		"serial_number": "222222",
+	}, nil)
+	dataBagsAPI.On("GetItem", "pending_sensors", "333333").Return(approved("333333"), nil)
+	done := approved("444444")
+	done["status"] = "approved"
+	dataBagsAPI.On("GetItem", "pending_sensors", "444444").Return(done, nil)
+	dataBagsAPI.On("UpdateItem", "pending_sensors", mock.Anything, mock.Anything).Return(nil)
+
+	chefUpdater := unknownSensorsUpdater(ProvisioningConfig{
+		Mode:        ProvisionDataBag,
+		NodePrefix:  "sensor-",
+		DataBagName: "pending_sensors",
+	})
+	chefUpdater.client = nodesAPI
+	chefUpdater.dataBags = dataBagsAPI
+	chefUpdater.OrganizationUUIDPath = "org/organization_uuid"
+	chefUpdater.DataBagName = "rBglobal"
+	chefUpdater.DataBagItem = "licenses"
+
+	summary, err := chefUpdater.FetchNodes()
+	assert.NoError(t, err)
+	assert.Empty(t, summary.Errors)
+	assert.Equal(t, 2, summary.Approved)
+
+	nodesAPI.AssertExpectations(t)
+	dataBagsAPI.AssertNumberOfCalls(t, "UpdateItem", 2)
+
+	// A new node is created with the approved UUIDs
+	node := nodesAPI.Calls[1].Arguments.Get(0).(chef.Node)
+	attrs, err := getParent(node.NormalAttributes, "org/uuid")
+	assert.NoError(t, err)
+	assert.Equal(t, "uuid-111111", attrs["uuid"])
+	assert.Equal(t, "org", attrs["organization_uuid"])
+	assert.Equal(t, "111111", attrs["serial_number"])
+	assert.Equal(t, "10.0.0.1", attrs["ipaddress"])
+	assert.Equal(t, true, attrs["blocked"])
+
+	// An existing node is updated, keeping its blocked status
+	node = nodesAPI.Calls[4].Arguments.Get(0).(chef.Node)
+	attrs, err = getParent(node.NormalAttributes, "org/uuid")
+	assert.NoError(t, err)
+	assert.Equal(t, "uuid-333333", attrs["uuid"])
+	assert.Equal(t, true, attrs["blocked"])
+
+	item := dataBagsAPI.Calls[len(dataBagsAPI.Calls)-2].Arguments.Get(2).(map[string]interface{})
+	assert.Equal(t, "approved", item["status"])
+
+	// Only the items not approved yet are read again
+	_, err = chefUpdater.FetchNodes()
+	assert.NoError(t, err)
+
+	reads := make(map[string]int)
+	for _, call := range dataBagsAPI.Calls {
+		if call.Method == "GetItem" && call.Arguments.String(0) == "pending_sensors" {
+			reads[call.Arguments.String(1)]++
+		}
+	}
+	assert.Equal(t, map[string]int{
+		"111111": 1, "222222": 2, "333333": 1, "444444": 1,
+	}, reads)
+}
+
+func TestProvisioningRate(t *testing.T) {
+	nodesAPI := new(ChefNodesMock)
+	nodesAPI.On("Post", mock.AnythingOfType("chef.Node")).Return(&chef.NodeResult{}, nil)
+
+	chefUpdater := unknownSensorsUpdater(ProvisioningConfig{
+		Mode: ProvisionNode,
+		Rate: 2,
+	})
+	chefUpdater.client = nodesAPI
+
+	for _, serialNumber := range []string{"111111", "222222", "333333"} {
+		for i := 0; i < 2; i++ {
+			chefUpdater.UpdateNode(net.ParseIP("10.0.0.1"), serialNumber, 10, 999)
+		}
+	}
+
+	nodesAPI.AssertNumberOfCalls(t, "Post", 2)
+	assert.False(t, chefUpdater.UnknownSensors()[2].Provisioned)
+}
+
+func TestProvisioningConfig(t *testing.T) {
+	assert.NoError(t, ProvisioningConfig{}.validate())
+	assert.NoError(t, ProvisioningConfig{Mode: ProvisionNode}.validate())
+	assert.Error(t, ProvisioningConfig{Mode: ProvisionDataBag}.validate())
+	assert.Error(t, ProvisioningConfig{Mode: "sensor"}.validate())
+}